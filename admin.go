@@ -0,0 +1,331 @@
+package mitch
+
+import (
+	"crypto/subtle"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (s *server) adminRoutes(route routeFunc) {
+	route("/@admin/fixture", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				err := r.store.loadFixture(r.req.Body)
+				if err != nil {
+					Throw(400, err.Error())
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/users", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				displayName := r.Param("display_name")
+				if displayName == "" {
+					Throw(400, "missing display_name")
+				}
+
+				user := r.store.makeUser(displayName)
+				user.Developer = r.BoolParam("developer")
+				user.PressUser = r.BoolParam("press_user")
+				if password := r.Param("password"); password != "" {
+					user.setPassword(password)
+				}
+				if secret := r.Param("totp_secret"); secret != "" {
+					if _, err := decodeTOTPSecret(secret); err != nil {
+						Throw(400, err.Error())
+					}
+					user.setTOTPSecret(secret)
+				}
+				r.WriteJSON(Any{
+					"user": FormatUser(user),
+				})
+			},
+		})
+	})
+
+	route("/@admin/users/{id}/api-keys", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				user := r.FindUser(r.Int64Var("id"))
+
+				var ttl time.Duration
+				if r.Param("ttl") != "" {
+					var err error
+					ttl, err = time.ParseDuration(r.Param("ttl"))
+					if err != nil {
+						Throw(400, "invalid ttl")
+					}
+				}
+				key := r.Param("key")
+				if key != "" && r.store.findAPIKeyByKey(key) != nil {
+					Throw(400, "key already in use")
+				}
+
+				var apiKey *APIKey
+				if scopes := r.Param("scopes"); scopes != "" || ttl != 0 {
+					apiKey = user.makeAPIKeyWithScopes(splitList(scopes), ttl)
+				} else {
+					apiKey = user.makeAPIKey(uuid.New().String())
+				}
+				if key != "" {
+					apiKey.setKey(key)
+				}
+				r.WriteJSON(Any{
+					"api_key": FormatAPIKey(apiKey),
+				})
+			},
+		})
+	})
+
+	route("/@admin/users/{id}/oauth-apps", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				user := r.FindUser(r.Int64Var("id"))
+				name := r.Param("name")
+				if name == "" {
+					Throw(400, "missing name")
+				}
+				clientID := r.Param("client_id")
+				if clientID != "" && r.store.findOAuthAppByClientID(clientID) != nil {
+					Throw(400, "client_id already in use")
+				}
+
+				app := user.makeOAuthApp(name, r.Param("redirect_uri"))
+				if clientID != "" {
+					app.ClientID = clientID
+				}
+				if secret := r.Param("client_secret"); secret != "" {
+					app.ClientSecret = secret
+				}
+				app.AutoDeny = r.BoolParam("auto_deny")
+				r.WriteJSON(Any{
+					"oauth_app": Any{
+						"id":            app.ID,
+						"user_id":       app.UserID,
+						"name":          app.Name,
+						"client_id":     app.ClientID,
+						"client_secret": app.ClientSecret,
+						"redirect_uri":  app.RedirectURI,
+					},
+				})
+			},
+		})
+	})
+
+	route("/@admin/users/{id}/games", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				user := r.FindUser(r.Int64Var("id"))
+				title := r.Param("title")
+				if title == "" {
+					Throw(400, "missing title")
+				}
+
+				game := user.makeGame(title)
+				if r.Param("min_price") != "" {
+					game.MinPrice = r.Int64Param("min_price")
+				}
+				if r.BoolParam("published") {
+					game.publish()
+				}
+				r.WriteJSON(Any{
+					"game": FormatGame(game),
+				})
+			},
+		})
+	})
+
+	route("/@admin/games/{id}/publish", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				game := r.FindGame(r.Int64Var("id"))
+				game.publish()
+				r.WriteJSON(Any{
+					"game": FormatGame(game),
+				})
+			},
+		})
+	})
+
+	route("/@admin/games/{id}/unpublish", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				game := r.FindGame(r.Int64Var("id"))
+				game.unpublish()
+				r.WriteJSON(Any{
+					"game": FormatGame(game),
+				})
+			},
+		})
+	})
+
+	route("/@admin/games/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAdminToken()
+				if !r.store.deleteGame(r.Int64Var("id")) {
+					Throw(404, "game not found")
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/games/{id}/admins", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				game := r.FindGame(r.Int64Var("id"))
+				user := r.FindUser(r.Int64Param("user_id"))
+
+				ga := game.addAdmin(user)
+				r.WriteJSON(Any{
+					"game_admin": Any{
+						"id":      ga.ID,
+						"game_id": ga.GameID,
+						"user_id": ga.UserID,
+					},
+				})
+			},
+		})
+	})
+
+	route("/@admin/games/{id}/uploads", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				game := r.FindGame(r.Int64Var("id"))
+
+				upload := game.makeUpload(r.Param("title"))
+				upload.ChannelName = r.Param("channel")
+				upload.Demo = r.BoolParam("demo")
+				upload.Preorder = r.BoolParam("preorder")
+				upload.Hidden = r.BoolParam("hidden")
+				if platforms := r.Param("platforms"); platforms != "" {
+					err := upload.setPlatforms(strings.Split(platforms, ","))
+					if err != nil {
+						Throw(400, err.Error())
+					}
+				}
+				r.WriteJSON(Any{
+					"upload": FormatUpload(upload),
+				})
+			},
+		})
+	})
+
+	route("/@admin/uploads/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAdminToken()
+				if !r.store.deleteUpload(r.Int64Var("id")) {
+					Throw(404, "upload not found")
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/uploads/{id}/builds", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+				upload := r.FindUpload(r.Int64Var("id"))
+
+				// same format as a build in a fixture, for example:
+				// {"entries": [{"path": "hello.txt", "string": "hi"}]}
+				var fb FixtureBuild
+				r.ReadYAMLBody(&fb)
+				build := upload.applyFixtureBuild(&fb)
+				r.WriteJSON(Any{
+					"build": FormatBuild(build),
+				})
+			},
+		})
+	})
+
+	route("/@admin/builds/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAdminToken()
+				if !r.store.deleteBuild(r.Int64Var("id")) {
+					Throw(404, "build not found")
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/cdn-faults", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAdminToken()
+
+				// for example: {"path": "/uploads/110", "fail_status": 503, "times": 2}
+				var fault CDNFault
+				r.ReadYAMLBody(&fault)
+				err := r.s.SetCDNFault(fault)
+				if err != nil {
+					Throw(400, err.Error())
+				}
+				r.WriteEmpty()
+			},
+			"DELETE": func() {
+				r.CheckAdminToken()
+				r.s.ClearCDNFaults()
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/api-keys/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAdminToken()
+				if !r.store.deleteAPIKey(r.Int64Var("id")) {
+					Throw(404, "api key not found")
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/@admin/game-admins/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAdminToken()
+				if !r.store.deleteGameAdmin(r.Int64Var("id")) {
+					Throw(404, "game admin not found")
+				}
+				r.WriteEmpty()
+			},
+		})
+	})
+}
+
+func (r *response) CheckAdminToken() {
+	adminToken := r.s.opts.adminToken
+	if adminToken == "" {
+		Throw(404, "admin api is disabled")
+	}
+
+	token := r.req.Header.Get("X-Admin-Token")
+	if token == "" {
+		Throw(401, "admin token required")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		Throw(403, "invalid admin token")
+	}
+}
@@ -0,0 +1,183 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AdminToken(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	status, _ := adminRequest(t, srv, "POST", "/@admin/users", url.Values{"display_name": {"Nope"}})
+	assert.EqualValues(404, status, "admin api is disabled without a token")
+
+	srv, err = NewServer(ctx, WithAdminToken("admin-token"))
+	assert.NoError(err)
+	status, _ = apiRequest(t, srv, "POST", "/@admin/users", "", url.Values{"display_name": {"Nope"}})
+	assert.EqualValues(401, status)
+	header := make(http.Header)
+	header.Set("X-Admin-Token", "wrong-token")
+	status, _ = formRequest(t, srv, "POST", "/@admin/users", header, url.Values{"display_name": {"Nope"}})
+	assert.EqualValues(403, status)
+	assert.Nil(srv.Store().FindUserByUsername("nope"))
+}
+
+func Test_AdminCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx, WithAdminToken("admin-token"))
+	assert.NoError(err)
+	store := srv.Store()
+
+	status, _ := adminRequest(t, srv, "POST", "/@admin/users", url.Values{})
+	assert.EqualValues(400, status)
+	status, _ = adminRequest(t, srv, "POST", "/@admin/users", url.Values{
+		"display_name": {"Some Developer"},
+		"developer":    {"true"},
+		"totp_secret":  {"not base32!"},
+	})
+	assert.EqualValues(400, status)
+
+	status, payload := adminRequest(t, srv, "POST", "/@admin/users", url.Values{
+		"display_name": {"Some Developer"},
+		"developer":    {"true"},
+		"password":     {"hunter2"},
+	})
+	assert.EqualValues(200, status)
+	user := payload["user"].(map[string]interface{})
+	assert.EqualValues("some-developer", user["username"])
+	assert.EqualValues(true, user["developer"])
+	userID := int64(user["id"].(float64))
+	assert.True(store.FindUser(userID).CheckPassword("hunter2"))
+
+	status, payload = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/api-keys", userID), url.Values{
+		"key":    {"dev-key"},
+		"scopes": {"profile:me,wharf"},
+		"ttl":    {"1h"},
+	})
+	assert.EqualValues(200, status)
+	apiKey := payload["api_key"].(map[string]interface{})
+	assert.EqualValues([]interface{}{"profile:me", "wharf"}, apiKey["scopes"])
+	assert.NotEmpty(apiKey["expires_at"])
+	assert.NotNil(store.FindAPIKeysByKey("dev-key"))
+	keyCount := len(store.APIKeys)
+	status, _ = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/api-keys", userID), url.Values{"key": {"dev-key"}})
+	assert.EqualValues(400, status)
+	assert.Len(store.APIKeys, keyCount, "nothing is created for a taken key")
+	status, _ = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/api-keys", userID), url.Values{"ttl": {"forever"}})
+	assert.EqualValues(400, status)
+	status, _ = adminRequest(t, srv, "POST", "/@admin/users/1/api-keys", url.Values{})
+	assert.EqualValues(404, status)
+
+	status, _ = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/games", userID), url.Values{})
+	assert.EqualValues(400, status)
+	status, payload = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/games", userID), url.Values{
+		"title":     {"Some Game"},
+		"min_price": {"500"},
+		"published": {"true"},
+	})
+	assert.EqualValues(200, status)
+	game := payload["game"].(map[string]interface{})
+	assert.EqualValues(500, game["min_price"])
+	gameID := int64(game["id"].(float64))
+	assert.True(store.FindGame(gameID).Published)
+
+	status, payload = adminRequest(t, srv, "POST", "/@admin/users", url.Values{"display_name": {"Some Admin"}})
+	assert.EqualValues(200, status)
+	adminID := int64(payload["user"].(map[string]interface{})["id"].(float64))
+	status, payload = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/games/%d/admins", gameID), url.Values{
+		"user_id": {fmt.Sprintf("%d", adminID)},
+	})
+	assert.EqualValues(200, status)
+	assert.EqualValues(adminID, payload["game_admin"].(map[string]interface{})["user_id"])
+	assert.Len(store.ListGameAdminsByGame(gameID), 1)
+
+	status, _ = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/games/%d/uploads", gameID), url.Values{
+		"platforms": {"windows,amiga"},
+	})
+	assert.EqualValues(400, status)
+	status, payload = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/games/%d/uploads", gameID), url.Values{
+		"title":     {"Windows build"},
+		"channel":   {"windows"},
+		"platforms": {"windows"},
+		"demo":      {"true"},
+	})
+	assert.EqualValues(200, status)
+	upload := payload["upload"].(map[string]interface{})
+	assert.EqualValues(true, upload["demo"])
+	assert.EqualValues(map[string]interface{}{"windows": "all"}, upload["platforms"])
+	uploadID := int64(upload["id"].(float64))
+	assert.EqualValues("windows", store.FindUpload(uploadID).ChannelName)
+
+	status, payload = adminYAMLRequest(t, srv, fmt.Sprintf("/@admin/uploads/%d/builds", uploadID),
+		`{"entries": [{"path": "hello.txt", "string": "hi"}]}`)
+	assert.EqualValues(200, status)
+	build := payload["build"].(map[string]interface{})
+	assert.EqualValues(1, build["version"])
+	assert.EqualValues(build["id"], store.FindUpload(uploadID).Head)
+	status, _ = adminYAMLRequest(t, srv, fmt.Sprintf("/@admin/uploads/%d/builds", uploadID), `{"entrees": []}`)
+	assert.EqualValues(400, status)
+
+	status, _ = adminYAMLRequest(t, srv, "/@admin/cdn-faults", `{"fail_status": 503}`)
+	assert.EqualValues(400, status)
+	status, _ = adminYAMLRequest(t, srv, "/@admin/cdn-faults", `{"path": "/uploads", "fail_status": 42}`)
+	assert.EqualValues(400, status)
+	status, _ = adminYAMLRequest(t, srv, "/@admin/cdn-faults", `{"path": "/uploads", "drop_after": -1}`)
+	assert.EqualValues(400, status)
+	status, _ = adminYAMLRequest(t, srv, "/@admin/cdn-faults", `{"path": "/uploads", "fail_status": 503}`)
+	assert.EqualValues(204, status)
+}
+
+func Test_AdminFixture(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx, WithAdminToken("admin-token"))
+	assert.NoError(err)
+	store := srv.Store()
+
+	status, _ := adminYAMLRequest(t, srv, "/@admin/fixture", testFixture)
+	assert.EqualValues(204, status)
+	assert.NotNil(store.FindAPIKeysByKey("dev-key"))
+
+	// loading it again would create duplicate users
+	status, _ = adminYAMLRequest(t, srv, "/@admin/fixture", testFixture)
+	assert.EqualValues(400, status)
+	assert.Len(store.SearchUsers("developer"), 1)
+
+	status, _ = adminYAMLRequest(t, srv, "/@admin/fixture", `
+users:
+  - name: Early Bird
+    games: [{title: Early Game}]
+  - name: Late Bird
+    games: [{title: Late Game, platforms: [amiga]}]
+`)
+	assert.EqualValues(400, status)
+	assert.Nil(store.FindUserByUsername("early-bird"))
+	assert.Empty(store.SearchGames("early"))
+
+	status, _ = adminYAMLRequest(t, srv, "/@admin/fixture", "users: {not: a list}")
+	assert.EqualValues(400, status)
+}
+
+// adminYAMLRequest POSTs a YAML (or JSON) body to an admin route
+func adminYAMLRequest(t *testing.T, srv Server, path string, body string) (int, Any) {
+	header := make(http.Header)
+	header.Set("X-Admin-Token", "admin-token")
+	header.Set("Content-Type", "application/yaml")
+	return bodyRequest(t, srv, "POST", path, header, strings.NewReader(body))
+}
@@ -1,9 +1,13 @@
 package mitch
 
+import (
+	"strings"
+	"time"
+)
+
 func (u *Upload) CanBeViewedBy(user *User) bool {
-	// TODO: download keys etc.
 	s := u.Store
-	g := s.FindGame(u.GameID)
+	g := s.findGame(u.GameID)
 	if g == nil {
 		Throw(404, "game not found")
 	}
@@ -19,6 +23,20 @@ func (s *UserGameSession) CanBeEditedBy(user *User) bool {
 	return user.ID == s.UserID
 }
 
+func (c *Collection) CanBeViewedBy(user *User) bool {
+	return user.ID == c.UserID
+}
+
+// IsListedFor returns false for hidden uploads, unless the
+// user is one of the game's editors.
+func (u *Upload) IsListedFor(user *User) bool {
+	if !u.Hidden {
+		return true
+	}
+	g := u.Store.findGame(u.GameID)
+	return g != nil && g.CanBeEditedBy(user)
+}
+
 func (g *Game) CanBeViewedBy(user *User) bool {
 	if g.CanBeEditedBy(user) {
 		return true
@@ -35,7 +53,7 @@ func (g *Game) CanBeEditedBy(user *User) bool {
 	if g.UserID == user.ID {
 		return true
 	}
-	admins := s.ListGameAdminsByGame(g.ID)
+	admins := s.listGameAdminsByGame(g.ID)
 	for _, a := range admins {
 		if a.UserID == user.ID {
 			return true
@@ -44,8 +62,78 @@ func (g *Game) CanBeEditedBy(user *User) bool {
 	return false
 }
 
-func (u *Upload) CanBeDownloadedBy(user *User) bool {
-	// TODO: download keys, min prices, etc.
-	g := u.Store.FindGame(u.GameID)
-	return g.CanBeViewedBy(user)
+func (u *Upload) CanBeDownloadedBy(user *User, dk *DownloadKey) bool {
+	g := u.Store.findGame(u.GameID)
+	if g == nil {
+		Throw(404, "game not found")
+	}
+	if u.Preorder && !g.CanBeEditedBy(user) {
+		return false
+	}
+	return g.CanBeDownloadedBy(user, dk)
+}
+
+// CanBeDownloadedBy checks that the user can view the game, and that
+// they pass a valid download key if the game isn't free. dk may be nil.
+func (g *Game) CanBeDownloadedBy(user *User, dk *DownloadKey) bool {
+	if dk != nil && !dk.CanBeUsedBy(user, g) {
+		return false
+	}
+	if g.CanBeEditedBy(user) {
+		return true
+	}
+	if !g.CanBeViewedBy(user) {
+		return false
+	}
+	if g.MinPrice > 0 && dk == nil {
+		return false
+	}
+	return true
+}
+
+func (dk *DownloadKey) CanBeUsedBy(user *User, g *Game) bool {
+	if dk.GameID != g.ID {
+		return false
+	}
+	if dk.OwnerID != 0 && dk.OwnerID != user.ID {
+		return false
+	}
+	return true
+}
+
+func (k *APIKey) IsExpired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt)
+}
+
+// HasScope returns true if the key can be used for routes
+// requiring scope. Scopes are hierarchical, so a "game:view"
+// key can also be used for "game:view:purchases".
+func (k *APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
+	for _, s := range k.Scopes {
+		if s == scope || strings.HasPrefix(scope, s+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes returns true if other can't do anything k can't: its scopes
+// are a subset of k's, and it doesn't outlive k. Keys can only see and
+// revoke the keys they include.
+func (k *APIKey) Includes(other *APIKey) bool {
+	if len(other.Scopes) == 0 && len(k.Scopes) > 0 {
+		return false
+	}
+	for _, scope := range other.Scopes {
+		if !k.HasScope(scope) {
+			return false
+		}
+	}
+	if !k.ExpiresAt.IsZero() && (other.ExpiresAt.IsZero() || other.ExpiresAt.After(k.ExpiresAt)) {
+		return false
+	}
+	return true
 }
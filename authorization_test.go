@@ -0,0 +1,270 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_DownloadKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	dev := s.MakeUser("Developer")
+	buyer := s.MakeUser("Buyer")
+	other := s.MakeUser("Other")
+
+	game := dev.MakeGame("Paid game")
+	game.MinPrice = 500
+	game.Publish()
+	upload := game.MakeUpload("Paid upload")
+
+	otherGame := dev.MakeGame("Other game")
+	otherGame.Publish()
+
+	dk := buyer.BuyGame(game)
+	otherKey := buyer.BuyGame(otherGame)
+	anonKey := game.MakeDownloadKey()
+
+	assert.True(upload.CanBeViewedBy(buyer))
+	assert.True(upload.CanBeDownloadedBy(dev, nil))
+	assert.False(upload.CanBeDownloadedBy(buyer, nil))
+	assert.True(upload.CanBeDownloadedBy(buyer, dk))
+	assert.False(upload.CanBeDownloadedBy(buyer, otherKey))
+	assert.False(upload.CanBeDownloadedBy(other, dk))
+	assert.True(upload.CanBeDownloadedBy(other, anonKey))
+
+	game.MinPrice = 0
+	assert.True(upload.CanBeDownloadedBy(other, nil))
+	assert.False(upload.CanBeDownloadedBy(buyer, otherKey))
+}
+
+func Test_DownloadKeyParam(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Developer")
+	buyer := store.MakeUser("Buyer")
+	buyerKey := buyer.MakeAPIKey().Key
+	other := store.MakeUser("Other")
+	otherKey := other.MakeAPIKey().Key
+
+	game := dev.MakeGame("Paid game")
+	game.MinPrice = 500
+	game.Publish()
+	upload := game.MakeUpload("Paid upload")
+	upload.SetZipContents()
+	dk := buyer.BuyGame(game)
+
+	with := func(dkParam string) url.Values {
+		return url.Values{"download_key_id": {dkParam}}
+	}
+	dkID := fmt.Sprintf("%d", dk.ID)
+	paths := []string{
+		fmt.Sprintf("/games/%d/uploads", game.ID),
+		fmt.Sprintf("/uploads/%d/download", upload.ID),
+	}
+	for _, path := range paths {
+		status, _ := apiRequest(t, srv, "GET", path, buyerKey, with(dkID))
+		assert.EqualValues(200, status, path)
+		status, _ = apiRequest(t, srv, "GET", path, buyerKey, nil)
+		assert.EqualValues(403, status, path)
+
+		status, _ = apiRequest(t, srv, "GET", path, otherKey, with(dkID))
+		assert.EqualValues(403, status, "someone else's download key on %s", path)
+		status, _ = apiRequest(t, srv, "GET", path, otherKey, with("1"))
+		assert.EqualValues(403, status, path)
+		status, _ = apiRequest(t, srv, "GET", path, otherKey, with("nope"))
+		assert.EqualValues(400, status, path)
+	}
+}
+
+func Test_APIKeyScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Scoped user")
+
+	fullKey := user.MakeAPIKey()
+	assert.True(fullKey.HasScope("wharf"))
+	assert.False(fullKey.IsExpired(time.Now().Add(24 * time.Hour)))
+
+	scopedKey := user.MakeAPIKeyWithScopes([]string{"profile:me", "game:view"}, time.Hour)
+	assert.True(scopedKey.HasScope("profile:me"))
+	assert.True(scopedKey.HasScope("game:view:purchases"))
+	assert.False(scopedKey.HasScope("game"))
+	assert.False(scopedKey.HasScope("wharf"))
+	assert.False(scopedKey.IsExpired(time.Now()))
+	assert.True(scopedKey.IsExpired(time.Now().Add(2 * time.Hour)))
+}
+
+func Test_CheckAPIKey(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	user := srv.Store().MakeUser("Scoped user")
+
+	validKey := user.MakeAPIKeyWithScopes([]string{"profile:me"}, time.Hour).Key
+	expiredKey := user.MakeAPIKeyWithScopes([]string{"profile:me"}, -time.Minute).Key
+
+	status, _ := apiRequest(t, srv, "GET", "/profile", validKey, nil)
+	assert.EqualValues(200, status)
+	status, _ = apiRequest(t, srv, "GET", "/profile", "Bearer "+validKey, nil)
+	assert.EqualValues(200, status)
+
+	status, payload := apiRequest(t, srv, "GET", "/profile", expiredKey, nil)
+	assert.EqualValues(401, status)
+	assert.EqualValues([]interface{}{"invalid key: expired"}, payload["errors"])
+
+	status, _ = apiRequest(t, srv, "GET", "/profile", "", nil)
+	assert.EqualValues(401, status)
+	status, _ = apiRequest(t, srv, "GET", "/profile", "no-such-key", nil)
+	assert.EqualValues(403, status)
+	status, _ = apiRequest(t, srv, "GET", "/profile/owned-keys", validKey, nil)
+	assert.EqualValues(403, status)
+}
+
+func Test_ProfileAPIKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	user := srv.Store().MakeUser("Key holder")
+
+	fullKey := user.MakeAPIKey()
+	wideKey := user.MakeAPIKeyWithScopes([]string{"profile", "wharf"}, 2*time.Hour)
+	narrowKey := user.MakeAPIKeyWithScopes([]string{"profile:me"}, time.Hour)
+	longNarrowKey := user.MakeAPIKeyWithScopes([]string{"profile:me"}, 3*time.Hour)
+
+	listIDs := func(apiKey *APIKey) []int64 {
+		status, payload := apiRequest(t, srv, "GET", "/profile/api-keys", apiKey.Key, nil)
+		assert.EqualValues(200, status)
+		var ids []int64
+		for _, k := range payload["api_keys"].([]interface{}) {
+			ids = append(ids, int64(k.(map[string]interface{})["id"].(float64)))
+		}
+		return ids
+	}
+	assert.EqualValues([]int64{fullKey.ID, wideKey.ID, narrowKey.ID, longNarrowKey.ID}, listIDs(fullKey))
+	assert.EqualValues([]int64{wideKey.ID, narrowKey.ID}, listIDs(wideKey), "no wider or longer-lived keys")
+	assert.EqualValues([]int64{narrowKey.ID}, listIDs(narrowKey))
+
+	create := func(apiKey *APIKey, scopes string) (int, map[string]interface{}) {
+		status, payload := apiRequest(t, srv, "POST", "/profile/api-keys", apiKey.Key, url.Values{"scopes": {scopes}})
+		if status != 200 {
+			return status, nil
+		}
+		return status, payload["api_key"].(map[string]interface{})
+	}
+
+	status, created := create(narrowKey, "")
+	assert.EqualValues(200, status)
+	assert.EqualValues([]interface{}{"profile:me"}, created["scopes"])
+	createdKey := srv.Store().FindAPIKeysByKey(created["key"].(string))
+	assert.EqualValues(narrowKey.ExpiresAt, createdKey.ExpiresAt, "new keys don't outlive the one that made them")
+
+	status, _ = create(narrowKey, "profile:me,wharf")
+	assert.EqualValues(403, status)
+	status, created = create(wideKey, "profile:owned")
+	assert.EqualValues(200, status)
+	assert.EqualValues([]interface{}{"profile:owned"}, created["scopes"])
+	status, created = create(fullKey, "")
+	assert.EqualValues(200, status)
+	assert.Nil(created["scopes"])
+	assert.Nil(created["expires_at"])
+
+	remove := func(apiKey *APIKey, target *APIKey) int {
+		status, _ := apiRequest(t, srv, "DELETE", fmt.Sprintf("/profile/api-keys/%d", target.ID), apiKey.Key, nil)
+		return status
+	}
+	assert.EqualValues(403, remove(narrowKey, wideKey))
+	assert.EqualValues(403, remove(narrowKey, longNarrowKey))
+	assert.EqualValues(403, remove(wideKey, fullKey))
+	assert.NotNil(srv.Store().FindAPIKeysByKey(fullKey.Key))
+
+	assert.EqualValues(204, remove(wideKey, narrowKey))
+	assert.Nil(srv.Store().FindAPIKeysByKey(narrowKey.Key))
+	assert.EqualValues(404, remove(wideKey, narrowKey))
+	assert.EqualValues(204, remove(fullKey, longNarrowKey))
+	assert.EqualValues(204, remove(wideKey, wideKey))
+
+	other := srv.Store().MakeUser("Someone else").MakeAPIKey()
+	assert.EqualValues(404, remove(other, fullKey))
+}
+
+func Test_UploadFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	s := srv.Store()
+
+	dev := s.MakeUser("Dev")
+	devKey := dev.MakeAPIKey().Key
+	player := s.MakeUser("Player")
+	playerKey := player.MakeAPIKey().Key
+	game := dev.MakeGame("Upcoming")
+	game.Publish()
+
+	demo := game.MakeUpload("Demo")
+	demo.SetZipContents()
+	demo.SetDemo(true)
+	demo.SetMD5Hash("0123456789abcdef0123456789abcdef")
+
+	upload := game.MakeUpload("Soundtrack")
+	upload.SetZipContents()
+	assert.EqualValues("Soundtrack", upload.DisplayName)
+
+	upload.SetHidden(true)
+	assert.True(upload.IsListedFor(dev))
+	assert.False(upload.IsListedFor(player))
+
+	listed := func(apiKey string) []interface{} {
+		status, payload := apiRequest(t, srv, "GET", fmt.Sprintf("/games/%d/uploads", game.ID), apiKey, nil)
+		assert.EqualValues(200, status)
+		var res []interface{}
+		for _, u := range payload["uploads"].([]interface{}) {
+			formatted := u.(map[string]interface{})
+			if formatted["id"] == float64(demo.ID) {
+				assert.EqualValues(true, formatted["demo"])
+				assert.EqualValues("0123456789abcdef0123456789abcdef", formatted["md5_hash"])
+			}
+			res = append(res, formatted["id"])
+		}
+		return res
+	}
+	assert.EqualValues([]interface{}{float64(demo.ID), float64(upload.ID)}, listed(devKey))
+	assert.EqualValues([]interface{}{float64(demo.ID)}, listed(playerKey), "hidden uploads are only listed for editors")
+
+	upload.SetHidden(false)
+	upload.SetPreorder(true)
+	assert.True(upload.CanBeDownloadedBy(dev, nil))
+	assert.False(upload.CanBeDownloadedBy(player, nil))
+
+	download := func(apiKey string) int {
+		status, _ := apiRequest(t, srv, "GET", fmt.Sprintf("/uploads/%d/download", upload.ID), apiKey, nil)
+		return status
+	}
+	assert.EqualValues([]interface{}{float64(demo.ID), float64(upload.ID)}, listed(playerKey), "preorders are listed")
+	assert.EqualValues(403, download(playerKey), "but can't be downloaded yet")
+	assert.EqualValues(200, download(devKey))
+
+	upload.SetPreorder(false)
+	assert.EqualValues(200, download(playerKey))
+}
@@ -0,0 +1,159 @@
+package mitch
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CDNFault describes how the /@cdn handler should misbehave when
+// serving a given path, to exercise downloaders' retry and resume logic.
+type CDNFault struct {
+	// CDN path the fault applies to, for example "/uploads/110"
+	Path string `yaml:"path"`
+	// Only the first Times requests are affected. 0 means all of them.
+	Times int `yaml:"times"`
+
+	// Wait this long before responding
+	Stall time.Duration `yaml:"stall"`
+	// Respond with this HTTP status (say, 500 or 503) instead of the file
+	FailStatus int `yaml:"fail_status"`
+	// Close the connection after sending this many bytes of the body
+	DropAfter int64 `yaml:"drop_after"`
+	// Flip the bits of CorruptLength bytes starting at CorruptOffset
+	CorruptOffset int64 `yaml:"corrupt_offset"`
+	CorruptLength int64 `yaml:"corrupt_length"`
+	// Serve the whole file with a 200, even if a range was requested
+	IgnoreRange bool `yaml:"ignore_range"`
+
+	hits int
+}
+
+func (s *server) SetCDNFault(fault CDNFault) error {
+	err := fault.validate()
+	if err != nil {
+		return err
+	}
+
+	s.cdnFaultsMutex.Lock()
+	defer s.cdnFaultsMutex.Unlock()
+
+	fault.hits = 0
+	s.cdnFaults[fault.Path] = &fault
+	return nil
+}
+
+func (fault *CDNFault) validate() error {
+	if fault.Path == "" {
+		return errors.New("missing path")
+	}
+	if fault.FailStatus != 0 && (fault.FailStatus < 100 || fault.FailStatus > 599) {
+		return errors.Errorf("invalid fail_status %d", fault.FailStatus)
+	}
+	if fault.Times < 0 || fault.Stall < 0 || fault.DropAfter < 0 || fault.CorruptOffset < 0 || fault.CorruptLength < 0 {
+		return errors.New("times, stall, drop_after and corrupt_* can't be negative")
+	}
+	return nil
+}
+
+func (s *server) ClearCDNFaults() {
+	s.cdnFaultsMutex.Lock()
+	defer s.cdnFaultsMutex.Unlock()
+
+	s.cdnFaults = make(map[string]*CDNFault)
+}
+
+// takeCDNFault returns the fault that applies to this request
+// for the given path, if any, and counts it as a hit.
+func (s *server) takeCDNFault(path string) *CDNFault {
+	s.cdnFaultsMutex.Lock()
+	defer s.cdnFaultsMutex.Unlock()
+
+	fault := s.cdnFaults[path]
+	if fault == nil {
+		return nil
+	}
+	if fault.Times > 0 && fault.hits >= fault.Times {
+		return nil
+	}
+	fault.hits++
+
+	res := *fault
+	return &res
+}
+
+// applyCDNFault takes care of the faults that happen before
+// any data is sent: stalling and failing.
+func (r *response) applyCDNFault(fault *CDNFault) {
+	if fault.Stall > 0 {
+		r.s.Debugf("Stalling %s for %s", r.req.URL.Path, fault.Stall)
+		select {
+		case <-time.After(fault.Stall):
+		case <-r.req.Context().Done():
+			Throw(503, "client went away while stalling")
+		}
+	}
+
+	if fault.FailStatus != 0 {
+		Throw(fault.FailStatus, "injected fault")
+	}
+}
+
+func (fault *CDNFault) corrupt(data []byte) []byte {
+	if fault.CorruptLength <= 0 || fault.CorruptOffset >= int64(len(data)) {
+		return data
+	}
+
+	end := fault.CorruptOffset + fault.CorruptLength
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+
+	res := make([]byte, len(data))
+	copy(res, data)
+	for i := fault.CorruptOffset; i < end; i++ {
+		res[i] ^= 0xff
+	}
+	return res
+}
+
+var errDropped = errors.New("connection dropped by injected fault")
+
+// droppingWriter lets the first few bytes of the body through,
+// then drops the connection.
+type droppingWriter struct {
+	http.ResponseWriter
+	r         *response
+	remaining int64
+}
+
+func (dw *droppingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= dw.remaining {
+		n, err := dw.ResponseWriter.Write(p)
+		dw.remaining -= int64(n)
+		return n, err
+	}
+
+	n, _ := dw.ResponseWriter.Write(p[:dw.remaining])
+	dw.remaining = 0
+	dw.r.s.Debugf("Dropping connection for %s", dw.r.req.URL.Path)
+	dw.r.dropConnection()
+	return n, errDropped
+}
+
+// dropConnection abruptly closes the connection, after flushing
+// whatever was written so far.
+func (r *response) dropConnection() {
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	hj, ok := r.w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	must(err)
+	conn.Close()
+}
@@ -0,0 +1,203 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_CDNRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	srv.Store().UploadCDNFile("/ranges", "ranges.bin", []byte("0123456789abcdef"))
+
+	get := func(method string, rangeHeader string) (*http.Response, string) {
+		return cdnRequest(t, srv, method, "/ranges", "Range", rangeHeader)
+	}
+
+	res, body := get("GET", "")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues("bytes", res.Header.Get("Accept-Ranges"))
+	assert.EqualValues("0123456789abcdef", body)
+
+	res, body = get("GET", "bytes=4-7")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("bytes 4-7/16", res.Header.Get("Content-Range"))
+	assert.EqualValues("4567", body)
+
+	res, body = get("GET", "bytes=-3")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("def", body)
+
+	res, body = get("GET", "bytes=0-1,14-")
+	assert.EqualValues(206, res.StatusCode)
+	assert.Contains(res.Header.Get("Content-Type"), "multipart/byteranges")
+	assert.Contains(body, "Content-Range: bytes 14-15/16")
+
+	res, _ = get("GET", "bytes=16-")
+	assert.EqualValues(416, res.StatusCode)
+	assert.EqualValues("bytes */16", res.Header.Get("Content-Range"))
+
+	for _, malformed := range []string{"bytes=", "bytes=5-2", "bytes=a-b", "lines=1-2"} {
+		res, body = get("GET", malformed)
+		assert.EqualValues(200, res.StatusCode, malformed)
+		assert.EqualValues("0123456789abcdef", body, malformed)
+	}
+
+	res, body = get("HEAD", "")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues(16, res.ContentLength)
+	assert.EqualValues("", body)
+}
+
+func Test_CDNConditional(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	f := srv.Store().UploadCDNFile("/conditional", "conditional.bin", []byte("hello"))
+	assert.EqualValues("5d41402abc4b2a76b9719d911017c592", f.MD5)
+
+	res, _ := cdnRequest(t, srv, "GET", "/conditional", "", "")
+	assert.EqualValues(200, res.StatusCode)
+	etag := res.Header.Get("ETag")
+	assert.EqualValues(`"5d41402abc4b2a76b9719d911017c592"`, etag)
+	assert.EqualValues("md5=XUFAKrxLKna5cZ2REBfFkg==", res.Header.Get("x-goog-hash"))
+	lastModified := res.Header.Get("Last-Modified")
+	assert.NotEmpty(lastModified)
+
+	res, body := cdnRequest(t, srv, "GET", "/conditional", "If-None-Match", etag)
+	assert.EqualValues(304, res.StatusCode)
+	assert.EqualValues("", body)
+
+	res, _ = cdnRequest(t, srv, "GET", "/conditional", "If-None-Match", `"stale"`)
+	assert.EqualValues(200, res.StatusCode)
+
+	res, _ = cdnRequest(t, srv, "GET", "/conditional", "If-Modified-Since", lastModified)
+	assert.EqualValues(304, res.StatusCode)
+}
+
+func Test_CDNFaults(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	srv.Store().UploadCDNFile("/faulty", "faulty.bin", []byte("0123456789abcdef"))
+
+	get := func(rangeHeader string) (*http.Response, string) {
+		return cdnRequest(t, srv, "GET", "/faulty", "Range", rangeHeader)
+	}
+
+	for _, fault := range []CDNFault{
+		{FailStatus: 503},
+		{Path: "/faulty", FailStatus: 42},
+		{Path: "/faulty", FailStatus: 600},
+		{Path: "/faulty", Stall: -time.Second},
+		{Path: "/faulty", CorruptOffset: -1, CorruptLength: 2},
+		{Path: "/faulty", CorruptLength: -1},
+		{Path: "/faulty", DropAfter: -1},
+		{Path: "/faulty", Times: -1},
+	} {
+		assert.Error(srv.SetCDNFault(fault), "%+v", fault)
+	}
+	res, _ := get("")
+	assert.EqualValues(200, res.StatusCode, "invalid faults aren't set")
+
+	// fail_status, only for the first two requests
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", FailStatus: 503, Times: 2}))
+	for i := 0; i < 2; i++ {
+		res, _ := get("")
+		assert.EqualValues(503, res.StatusCode)
+	}
+	res, body := get("")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues("0123456789abcdef", body)
+
+	// setting a fault again resets its countdown, and
+	// 0 times means every request is affected
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", FailStatus: 500}))
+	for i := 0; i < 3; i++ {
+		res, _ = get("")
+		assert.EqualValues(500, res.StatusCode)
+	}
+	res, _ = cdnRequest(t, srv, "GET", "/ranges", "", "")
+	assert.EqualValues(404, res.StatusCode, "faults don't leak to other paths")
+	srv.ClearCDNFaults()
+	res, _ = get("")
+	assert.EqualValues(200, res.StatusCode)
+
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", Stall: 200 * time.Millisecond, Times: 1}))
+	start := time.Now()
+	res, body = get("")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues("0123456789abcdef", body)
+	assert.True(time.Since(start) >= 200*time.Millisecond, "first request is stalled")
+	start = time.Now()
+	get("")
+	assert.True(time.Since(start) < 200*time.Millisecond, "second request isn't")
+
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", CorruptOffset: 2, CorruptLength: 3}))
+	res, body = get("")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues("01\xcd\xcc\xcb56789abcdef", body)
+	res, body = get("bytes=0-5")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("01\xcd\xcc\xcb5", body, "corruption applies to ranges too")
+
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", IgnoreRange: true}))
+	res, body = get("bytes=4-7")
+	assert.EqualValues(200, res.StatusCode)
+	assert.EqualValues("", res.Header.Get("Content-Range"))
+	assert.EqualValues("0123456789abcdef", body)
+
+	assert.NoError(srv.SetCDNFault(CDNFault{Path: "/faulty", DropAfter: 6, Times: 1}))
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/@cdn/faulty", srv.Address()), nil)
+	assert.NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		assert.EqualValues(200, res.StatusCode)
+		assert.EqualValues(16, res.ContentLength)
+		partial, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Error(err, "connection is dropped")
+		assert.EqualValues("012345", string(partial))
+	}
+	res, body = get("bytes=6-")
+	assert.EqualValues(206, res.StatusCode)
+	assert.EqualValues("6789abcdef", body, "downloads can be resumed after a drop")
+}
+
+func cdnRequest(t *testing.T, srv Server, method string, path string, header string, value string) (*http.Response, string) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s/@cdn%s", srv.Address(), path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != "" && value != "" {
+		req.Header.Set(header, value)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
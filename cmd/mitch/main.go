@@ -2,33 +2,169 @@ package main
 
 import (
 	"context"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 
 	"github.com/itchio/mitch"
+	"github.com/pkg/errors"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	app  = kingpin.New("mitch", "mitch is a (m)ock (itch).io server.")
-	port int
+	app      = kingpin.New("mitch", "mitch is a (m)ock (itch).io server.")
+	port     int
+	dataFile string
+	save     bool
+	fixtures []string
+
+	adminToken string
+	cdnFaults  string
 )
 
 func flags() {
 	app.Flag("port", "Port to listen on").Short('p').Default("0").IntVar(&port)
+	app.Flag("data-file", "Store snapshot to load on startup, if it exists").StringVar(&dataFile)
+	app.Flag("save", "Save the store to --data-file on exit").BoolVar(&save)
+	app.Flag("admin-token", "Enable the /@admin API, guarded by this token").StringVar(&adminToken)
+	app.Flag("cdn-faults", "YAML or JSON list of faults to inject in CDN downloads").StringVar(&cdnFaults)
+	app.Flag("fixture", "YAML or JSON fixture to seed the store with (can be repeated)").StringsVar(&fixtures)
 }
 
 func main() {
 	flags()
 
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	if save && dataFile == "" {
+		app.Fatalf("--save requires --data-file")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		<-c
+		cancel()
+	}()
+
+	opts := []mitch.ServerOpt{mitch.WithPort(port)}
+	if adminToken != "" {
+		opts = append(opts, mitch.WithAdminToken(adminToken))
+	}
+	if dataFile != "" {
+		store, err := loadStore(dataFile)
+		if err != nil {
+			panic(err)
+		}
+		if store != nil {
+			log.Printf("Loaded store from %s", dataFile)
+			opts = append(opts, mitch.WithStore(store))
+		}
+	}
 
-	ctx := context.Background()
-	s, err := mitch.NewServer(ctx, mitch.WithPort(port))
+	s, err := mitch.NewServer(ctx, opts...)
 	if err != nil {
 		panic(err)
 	}
+	for _, fixture := range fixtures {
+		err := loadFixture(s.Store(), fixture)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Loaded fixture %s", fixture)
+	}
+	if cdnFaults != "" {
+		err := loadCDNFaults(s, cdnFaults)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Loaded CDN faults from %s", cdnFaults)
+	}
 	log.Printf("Now listening on %s", s.Address())
 	log.Printf("(Ctrl+C to exit)")
 	<-ctx.Done()
+
+	if save {
+		err := saveStore(s.Store(), dataFile)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Saved store to %s", dataFile)
+	}
+}
+
+func loadStore(path string) (*mitch.Store, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return mitch.LoadStore(f)
+}
+
+func loadFixture(store *mitch.Store, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return store.LoadFixture(f)
+}
+
+func loadCDNFaults(s mitch.Server, path string) error {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var faults []mitch.CDNFault
+	err = yaml.UnmarshalStrict(payload, &faults)
+	if err != nil {
+		return err
+	}
+
+	for _, fault := range faults {
+		err = s.SetCDNFault(fault)
+		if err != nil {
+			return errors.Wrapf(err, "in fault for %q", fault.Path)
+		}
+	}
+	return nil
+}
+
+// saveStore writes the snapshot next to path first, and only
+// replaces path once it's complete, so that a failed save doesn't
+// destroy the previous snapshot.
+func saveStore(store *mitch.Store, path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	// TempFile uses 0600, keep os.Create's permissions
+	err = f.Chmod(0644)
+	if err == nil {
+		err = store.Save(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
 }
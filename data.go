@@ -14,30 +14,63 @@ type Store struct {
 	BuildFiles       map[int64]*BuildFile
 	GameAdmins       map[int64]*GameAdmin
 	UserGameSessions map[int64]*UserGameSession
+	DownloadKeys     map[int64]*DownloadKey
+	OAuthApps        map[int64]*OAuthApp
+	Collections      map[int64]*Collection
+	CollectionGames  map[int64]*CollectionGame
+	Sales            map[int64]*Sale
 
-	CDNFiles map[string]*CDNFile
+	CDNFiles       map[string]*CDNFile
+	UploadSessions map[string]*UploadSession `json:"-"`
 
-	idSeed     int64
-	writeMutex sync.Mutex
+	// pending logins waiting for a TOTP code, by token
+	totpTokens map[string]int64
+	// browser sessions, by cookie value
+	sessions map[string]int64
+	// OAuth authorization codes that haven't been exchanged yet
+	oauthCodes map[string]*oauthCode
+
+	idSeed int64
+
+	indexes indexes
+
+	// mutex guards everything above, including the fields of the
+	// objects in the tables. Exported methods take it themselves
+	// and call their unexported counterparts, which expect it to be
+	// held already. HTTP handlers hold it for the whole request, and
+	// formatters and authorization checks expect it to be held.
+	mutex sync.RWMutex
 }
 
 func newStore() *Store {
-	return &Store{
-		Users:      make(map[int64]*User),
-		APIKeys:    make(map[int64]*APIKey),
-		Games:      make(map[int64]*Game),
-		Uploads:    make(map[int64]*Upload),
-		Builds:     make(map[int64]*Build),
-		BuildFiles: make(map[int64]*BuildFile),
-		GameAdmins: make(map[int64]*GameAdmin),
-
-		CDNFiles: make(map[string]*CDNFile),
-		idSeed:   10,
+	s := &Store{
+		Users:            make(map[int64]*User),
+		APIKeys:          make(map[int64]*APIKey),
+		Games:            make(map[int64]*Game),
+		Uploads:          make(map[int64]*Upload),
+		Builds:           make(map[int64]*Build),
+		BuildFiles:       make(map[int64]*BuildFile),
+		GameAdmins:       make(map[int64]*GameAdmin),
+		UserGameSessions: make(map[int64]*UserGameSession),
+		DownloadKeys:     make(map[int64]*DownloadKey),
+		OAuthApps:        make(map[int64]*OAuthApp),
+		Collections:      make(map[int64]*Collection),
+		CollectionGames:  make(map[int64]*CollectionGame),
+		Sales:            make(map[int64]*Sale),
+
+		CDNFiles:       make(map[string]*CDNFile),
+		UploadSessions: make(map[string]*UploadSession),
+		totpTokens:     make(map[string]int64),
+		sessions:       make(map[string]int64),
+		oauthCodes:     make(map[string]*oauthCode),
+		idSeed:         10,
 	}
+	s.reindex()
+	return s
 }
 
 type User struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID             int64
 	Username       string
@@ -46,20 +79,30 @@ type User struct {
 	Developer      bool
 	PressUser      bool
 	AllowTelemetry bool
+
+	// see login.go
+	PasswordHash    string
+	TOTPSecret      string
+	RecaptchaNeeded bool
 }
 
 type APIKey struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID        int64
 	UserID    int64
 	Key       string
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	// Empty means the key can be used for everything
+	Scopes []string
+	// Zero means the key never expires
+	ExpiresAt time.Time
 }
 
 type Game struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	Type           string
 	Classification string
@@ -68,13 +111,52 @@ type Game struct {
 	Title          string
 	MinPrice       int64
 	Published      bool
+
+	URL           string
+	CoverURL      string
+	StillCoverURL string
+	ShortText     string
+	CreatedAt     time.Time
+	PublishedAt   time.Time
+	CanBeBought   bool
+	HasDemo       bool
+	InPressSystem bool
+	// Only set for HTML games
+	Embed *GameEmbed
+
+	PlatformWindows bool
+	PlatformLinux   bool
+	PlatformMac     bool
+
+	// only visible to the game's editors, see /profile/games
+	ViewsCount     int64
+	DownloadsCount int64
+	PurchasesCount int64
+}
+
+type GameEmbed struct {
+	Width      int64
+	Height     int64
+	Fullscreen bool
+}
+
+// Sale discounts a game by Rate percent between StartDate and EndDate
+type Sale struct {
+	Store *Store `json:"-"`
+
+	ID        int64
+	GameID    int64
+	Rate      int64
+	StartDate time.Time
+	EndDate   time.Time
 }
 
 type Upload struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID          int64
 	GameID      int64
+	DisplayName string
 	Filename    string
 	URL         string
 	Size        int64
@@ -82,6 +164,16 @@ type Upload struct {
 	Storage     string
 	Head        int64
 	Type        string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+
+	Demo     bool
+	Preorder bool
+	// Hidden uploads are only listed for the game's editors
+	Hidden bool
+	// Overrides the hash of the file served for the upload,
+	// to test integrity checks
+	MD5Hash string
 
 	PlatformWindows bool
 	PlatformLinux   bool
@@ -89,16 +181,18 @@ type Upload struct {
 }
 
 type Build struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID            int64
 	ParentBuildID int64
 	UploadID      int64
 	Version       int
+	UserVersion   string
+	State         string
 }
 
 type BuildFile struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID      int64
 	BuildID int64
@@ -111,26 +205,91 @@ type BuildFile struct {
 }
 
 type GameAdmin struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID     int64
 	GameID int64
 	UserID int64
 }
 
+// DownloadKey grants access to the downloads of a game. Keys
+// with an OwnerID can only be used by that user.
+type DownloadKey struct {
+	Store *Store `json:"-"`
+
+	ID        int64
+	GameID    int64
+	OwnerID   int64
+	Key       string
+	CreatedAt time.Time
+}
+
+// OAuthApp is a third-party application that users can
+// authorize, see oauth.go
+type OAuthApp struct {
+	Store *Store `json:"-"`
+
+	ID           int64
+	UserID       int64
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	// When set, authorization requests are denied instead of approved
+	AutoDeny bool
+}
+
+type Collection struct {
+	Store *Store `json:"-"`
+
+	ID        int64
+	UserID    int64
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// CollectionGame is a game in a collection, sorted by Position
+type CollectionGame struct {
+	Store *Store `json:"-"`
+
+	ID           int64
+	CollectionID int64
+	GameID       int64
+	UserID       int64
+	Position     int64
+	CreatedAt    time.Time
+}
+
 type CDNFile struct {
 	Path     string
 	Filename string
 	Size     int64
 	Contents []byte
+
+	// hex-encoded digests of Contents
+	MD5        string
+	SHA256     string
+	UploadedAt time.Time
+}
+
+// UploadSession is a resumable upload in progress, see upload_session.go
+type UploadSession struct {
+	ID       string
+	Path     string
+	Filename string
+	Contents []byte
 }
 
 type UserGameSession struct {
-	Store *Store
+	Store *Store `json:"-"`
 
 	ID         int64
 	GameID     int64
 	UserID     int64
 	Crashed    bool
 	SecondsRun int64
+	LastRunAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
 }
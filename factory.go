@@ -3,27 +3,44 @@ package mitch
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/itchio/savior/seeksource"
 
 	"github.com/itchio/arkive/zip"
 
 	"github.com/itchio/headway/state"
 
+	"github.com/itchio/lake"
+	"github.com/itchio/lake/pools/nullpool"
 	"github.com/itchio/lake/pools/zippool"
+	"github.com/itchio/lake/pools/zipwriterpool"
 	"github.com/itchio/lake/tlc"
 
 	"github.com/itchio/wharf/pwr"
+	"github.com/itchio/wharf/pwr/bowl"
+	"github.com/itchio/wharf/pwr/patcher"
 	"github.com/itchio/wharf/wire"
 	"github.com/itchio/wharf/wsync"
+	"github.com/pkg/errors"
 )
 
+// Factory methods come in pairs: the exported one locks the store
+// and calls the unexported one, which expects the lock to be held.
+
 func (s *Store) MakeUser(displayName string) *User {
-	s.writeMutex.Lock()
-	defer s.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.makeUser(displayName)
+}
 
+func (s *Store) makeUser(displayName string) *User {
 	user := &User{
 		Store:       s,
 		ID:          s.serial(),
@@ -35,25 +52,77 @@ func (s *Store) MakeUser(displayName string) *User {
 	return user
 }
 
+// MakeAPIKey creates an API key with a random key string
 func (u *User) MakeAPIKey() *APIKey {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeAPIKey(uuid.New().String())
+}
+
+// MakeDeterministicAPIKey creates an API key whose key string
+// is derived from the username, like "alice-api-key".
+func (u *User) MakeDeterministicAPIKey() *APIKey {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeAPIKey(fmt.Sprintf("%s-api-key", u.Username))
+}
+
+func (u *User) makeAPIKey(key string) *APIKey {
 	s := u.Store
-	s.writeMutex.Lock()
-	defer s.writeMutex.Unlock()
 
+	now := time.Now().UTC()
 	apiKey := &APIKey{
-		Store:  s,
-		ID:     s.serial(),
-		UserID: u.ID,
-		Key:    fmt.Sprintf("%s-api-key", u.Username),
+		Store:     s,
+		ID:        s.serial(),
+		UserID:    u.ID,
+		Key:       key,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 	s.APIKeys[apiKey.ID] = apiKey
+	s.indexAPIKey(apiKey)
+	return apiKey
+}
+
+// MakeAPIKeyWithScopes makes a key that can only be used for routes
+// requiring one of the given scopes, and that expires after ttl
+// (unless ttl is zero).
+func (u *User) MakeAPIKeyWithScopes(scopes []string, ttl time.Duration) *APIKey {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeAPIKeyWithScopes(scopes, ttl)
+}
+
+// SetKey changes the key string used to authenticate.
+func (k *APIKey) SetKey(key string) {
+	k.Store.mutex.Lock()
+	defer k.Store.mutex.Unlock()
+	k.setKey(key)
+}
+
+func (k *APIKey) setKey(key string) {
+	k.Store.unindexAPIKey(k)
+	k.Key = key
+	k.Store.indexAPIKey(k)
+}
+
+func (u *User) makeAPIKeyWithScopes(scopes []string, ttl time.Duration) *APIKey {
+	apiKey := u.makeAPIKey(uuid.New().String())
+	apiKey.Scopes = scopes
+	if ttl != 0 {
+		apiKey.ExpiresAt = apiKey.CreatedAt.Add(ttl)
+	}
 	return apiKey
 }
 
 func (u *User) MakeGame(title string) *Game {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeGame(title)
+}
+
+func (u *User) makeGame(title string) *Game {
 	s := u.Store
-	s.writeMutex.Lock()
-	defer s.writeMutex.Unlock()
 
 	game := &Game{
 		Store:          s,
@@ -62,36 +131,355 @@ func (u *User) MakeGame(title string) *Game {
 		Classification: "game",
 		UserID:         u.ID,
 		Title:          title,
+		URL:            fmt.Sprintf("https://%s.itch.io/%s", u.Username, s.slugify(title)),
+		CreatedAt:      time.Now().UTC(),
 	}
 	s.Games[game.ID] = game
 	return game
 }
 
 func (g *Game) Publish() {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.publish()
+}
+
+func (g *Game) publish() {
 	g.Published = true
+	g.PublishedAt = time.Now().UTC()
 }
 
-func (g *Game) MakeUpload(title string) *Upload {
+// Unpublish turns the game back into a draft, only its
+// editors can see it afterwards.
+func (g *Game) Unpublish() {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.unpublish()
+}
+
+func (g *Game) unpublish() {
+	g.Published = false
+	g.PublishedAt = time.Time{}
+}
+
+func (g *Game) SetShortText(shortText string) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.ShortText = shortText
+}
+
+func (g *Game) SetCover(coverURL string, stillCoverURL string) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.setCover(coverURL, stillCoverURL)
+}
+
+func (g *Game) setCover(coverURL string, stillCoverURL string) {
+	g.CoverURL = coverURL
+	g.StillCoverURL = stillCoverURL
+}
+
+func (g *Game) SetCanBeBought(canBeBought bool) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.CanBeBought = canBeBought
+}
+
+func (g *Game) SetHasDemo(hasDemo bool) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.HasDemo = hasDemo
+}
+
+func (g *Game) SetInPressSystem(inPressSystem bool) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.InPressSystem = inPressSystem
+}
+
+// SetEmbed makes the game playable in the browser.
+func (g *Game) SetEmbed(width int64, height int64, fullscreen bool) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+
+	g.Type = "html"
+	g.Embed = &GameEmbed{
+		Width:      width,
+		Height:     height,
+		Fullscreen: fullscreen,
+	}
+}
+
+// SetPlatforms sets the platforms listed on the game page, on top of
+// the ones of its uploads. See Upload.SetPlatforms for accepted values.
+func (g *Game) SetPlatforms(platforms []string) error {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	return g.setPlatforms(platforms)
+}
+
+func (g *Game) setPlatforms(platforms []string) error {
+	return parsePlatforms(platforms, &g.PlatformWindows, &g.PlatformLinux, &g.PlatformMac)
+}
+
+// SetStats sets the counters shown on the developer dashboard.
+func (g *Game) SetStats(views, downloads, purchases int64) {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	g.setStats(views, downloads, purchases)
+}
+
+func (g *Game) setStats(views, downloads, purchases int64) {
+	g.ViewsCount = views
+	g.DownloadsCount = downloads
+	g.PurchasesCount = purchases
+}
+
+// StartSale discounts the game by rate percent, starting now.
+func (g *Game) StartSale(rate int64, duration time.Duration) *Sale {
 	s := g.Store
-	s.writeMutex.Lock()
-	defer s.writeMutex.Unlock()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	sale := &Sale{
+		Store:     s,
+		ID:        s.serial(),
+		GameID:    g.ID,
+		Rate:      rate,
+		StartDate: now,
+		EndDate:   now.Add(duration),
+	}
+	s.Sales[sale.ID] = sale
+	return sale
+}
 
-	upload := &Upload{
+// EndSale ends the game's current sale, if any.
+func (g *Game) EndSale() {
+	s := g.Store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sale := s.findActiveSaleByGame(g.ID)
+	if sale != nil {
+		sale.EndDate = time.Now().UTC()
+	}
+}
+
+func (g *Game) AddAdmin(u *User) *GameAdmin {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	return g.addAdmin(u)
+}
+
+func (g *Game) addAdmin(u *User) *GameAdmin {
+	s := g.Store
+
+	admin := &GameAdmin{
 		Store:  s,
 		ID:     s.serial(),
 		GameID: g.ID,
-		Type:   "default",
+		UserID: u.ID,
+	}
+	s.GameAdmins[admin.ID] = admin
+	s.indexGameAdmin(admin)
+	return admin
+}
+
+// MakeDownloadKey creates a download key for the game that
+// isn't owned by anyone, so any user can use it.
+func (g *Game) MakeDownloadKey() *DownloadKey {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	return g.makeDownloadKey(0)
+}
+
+// BuyGame gives the user a download key for the game.
+func (u *User) BuyGame(g *Game) *DownloadKey {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return g.makeDownloadKey(u.ID)
+}
+
+func (g *Game) makeDownloadKey(ownerID int64) *DownloadKey {
+	s := g.Store
+
+	dk := &DownloadKey{
+		Store:     s,
+		ID:        s.serial(),
+		GameID:    g.ID,
+		OwnerID:   ownerID,
+		Key:       uuid.New().String(),
+		CreatedAt: time.Now().UTC(),
+	}
+	s.DownloadKeys[dk.ID] = dk
+	return dk
+}
+
+// MakeGameSession records that the user just launched the game.
+func (u *User) MakeGameSession(g *Game) *UserGameSession {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeGameSession(g)
+}
+
+func (u *User) makeGameSession(g *Game) *UserGameSession {
+	s := u.Store
+
+	now := time.Now().UTC()
+	ugs := &UserGameSession{
+		Store:     s,
+		ID:        s.serial(),
+		GameID:    g.ID,
+		UserID:    u.ID,
+		LastRunAt: now,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.UserGameSessions[ugs.ID] = ugs
+	return ugs
+}
+
+// Update records how long the game has been running for so far.
+func (ugs *UserGameSession) Update(secondsRun int64, crashed bool, lastRunAt time.Time) {
+	ugs.Store.mutex.Lock()
+	defer ugs.Store.mutex.Unlock()
+	ugs.update(secondsRun, crashed, lastRunAt)
+}
+
+func (ugs *UserGameSession) update(secondsRun int64, crashed bool, lastRunAt time.Time) {
+	ugs.SecondsRun = secondsRun
+	ugs.Crashed = crashed
+	ugs.LastRunAt = lastRunAt
+	ugs.UpdatedAt = time.Now().UTC()
+}
+
+func (u *User) MakeCollection(title string) *Collection {
+	s := u.Store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	c := &Collection{
+		Store:     s,
+		ID:        s.serial(),
+		UserID:    u.ID,
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.Collections[c.ID] = c
+	return c
+}
+
+// AddGame appends a game at the end of the collection.
+func (c *Collection) AddGame(g *Game) *CollectionGame {
+	s := c.Store
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().UTC()
+	cg := &CollectionGame{
+		Store:        s,
+		ID:           s.serial(),
+		CollectionID: c.ID,
+		GameID:       g.ID,
+		UserID:       c.UserID,
+		Position:     int64(len(s.listCollectionGamesByCollection(c.ID))) + 1,
+		CreatedAt:    now,
+	}
+	s.CollectionGames[cg.ID] = cg
+	c.UpdatedAt = now
+	return cg
+}
+
+func (g *Game) MakeUpload(title string) *Upload {
+	g.Store.mutex.Lock()
+	defer g.Store.mutex.Unlock()
+	return g.makeUpload(title)
+}
+
+func (g *Game) makeUpload(title string) *Upload {
+	s := g.Store
+
+	now := time.Now().UTC()
+	upload := &Upload{
+		Store:       s,
+		ID:          s.serial(),
+		GameID:      g.ID,
+		DisplayName: title,
+		Type:        "default",
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 	s.Uploads[upload.ID] = upload
+	s.indexUpload(upload)
 	return upload
 }
 
 func (u *Upload) SetAllPlatforms() {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+
 	u.PlatformWindows = true
 	u.PlatformLinux = true
 	u.PlatformMac = true
 }
 
+// SetPlatforms accepts "windows", "linux", "mac" (or "osx") and "all"
+func (u *Upload) SetPlatforms(platforms []string) error {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.setPlatforms(platforms)
+}
+
+func (u *Upload) setPlatforms(platforms []string) error {
+	return parsePlatforms(platforms, &u.PlatformWindows, &u.PlatformLinux, &u.PlatformMac)
+}
+
+func (u *Upload) SetDemo(demo bool) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.Demo = demo
+}
+
+func (u *Upload) SetPreorder(preorder bool) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.Preorder = preorder
+}
+
+func (u *Upload) SetHidden(hidden bool) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.Hidden = hidden
+}
+
+// SetMD5Hash overrides the hash reported for the upload's file
+func (u *Upload) SetMD5Hash(md5Hash string) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.MD5Hash = md5Hash
+}
+
+func parsePlatforms(platforms []string, windows *bool, linux *bool, mac *bool) error {
+	for _, p := range platforms {
+		switch p {
+		case "windows":
+			*windows = true
+		case "linux":
+			*linux = true
+		case "mac", "osx":
+			*mac = true
+		case "all":
+			*windows, *linux, *mac = true, true, true
+		default:
+			return errors.Errorf("unknown platform %q", p)
+		}
+	}
+	return nil
+}
+
 func (u *Upload) SetZipContents() {
 	u.SetZipContentsCustom(func(ac *ArchiveContext) {
 		ac.Entry("hello.txt").String("Just a test file")
@@ -99,30 +487,58 @@ func (u *Upload) SetZipContents() {
 }
 
 func (u *Upload) SetZipContentsCustom(f func(ac *ArchiveContext)) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.setZipContentsCustom(f)
+}
+
+func (u *Upload) setZipContentsCustom(f func(ac *ArchiveContext)) {
 	ac := &ArchiveContext{
 		Entries: make(map[string]*ArchiveEntry),
 		Name:    fmt.Sprintf("upload-%d.zip", u.ID),
 	}
 	f(ac)
-	u.SetHostedContents(ac.Name, ac.CompressZip())
+	u.setHostedContents(ac.Name, ac.CompressZip())
 }
 
-func (u *Upload) PushBuild(f func(ac *ArchiveContext)) *Build {
+func (u *Upload) MakeBuild() *Build {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeBuild()
+}
+
+func (u *Upload) makeBuild() *Build {
 	s := u.Store
 
-	parentBuild := s.FindBuild(u.Head)
+	parentBuild := s.findBuild(u.Head)
 	b := &Build{
 		Store: s,
 
 		ID:       s.serial(),
 		UploadID: u.ID,
 		Version:  1,
+		State:    "started",
 	}
 	if parentBuild != nil {
 		b.ParentBuildID = parentBuild.ID
 		b.Version = parentBuild.Version + 1
 	}
 	s.Builds[b.ID] = b
+	s.indexBuild(b)
+	return b
+}
+
+func (u *Upload) PushBuild(f func(ac *ArchiveContext)) *Build {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.pushBuild(f)
+}
+
+func (u *Upload) pushBuild(f func(ac *ArchiveContext)) *Build {
+	s := u.Store
+
+	parentBuild := s.findBuild(u.Head)
+	b := u.makeBuild()
 
 	ac := &ArchiveContext{
 		Entries: make(map[string]*ArchiveEntry),
@@ -130,25 +546,148 @@ func (u *Upload) PushBuild(f func(ac *ArchiveContext)) *Build {
 	}
 	f(ac)
 
-	archiveFile := b.MakeFile("archive", "default")
-	archiveFile.SetHostedContents(ac.Name, ac.CompressZip())
+	archiveFile := b.makeFile("archive", "default")
+	archiveFile.setHostedContents(ac.Name, ac.CompressZip())
 
-	archiveFile.Sign()
+	archiveFile.sign()
 	if parentBuild != nil {
-		archiveFile.Diff(parentBuild)
+		archiveFile.diff(parentBuild)
 	}
 
-	u.Storage = "build"
-	u.Head = b.ID
+	b.commit()
 	u.Filename = archiveFile.Filename
 	u.Size = archiveFile.Size
+	return b
+}
+
+// Commit marks the build as completed and makes it the head of its upload.
+func (b *Build) Commit() {
+	b.Store.mutex.Lock()
+	defer b.Store.mutex.Unlock()
+	b.commit()
+}
+
+func (b *Build) commit() {
+	s := b.Store
+	u := s.findUpload(b.UploadID)
+	if u == nil {
+		panic("Build without Upload")
+	}
+
+	b.State = "completed"
+	u.Storage = "build"
+	u.Head = b.ID
+	u.UpdatedAt = time.Now().UTC()
 	if u.ChannelName == "" {
 		u.ChannelName = fmt.Sprintf("upload-%d", u.ID)
 	}
-	return b
+}
+
+// CommitIfReady commits the build once both its patch and its
+// signature have been uploaded, which is what a wharf push produces.
+// Like itch.io, it applies the patch to get the build's archive, and
+// marks the build as failed if that doesn't work.
+func (b *Build) CommitIfReady() error {
+	b.Store.mutex.Lock()
+	defer b.Store.mutex.Unlock()
+	return b.commitIfReady()
+}
+
+func (b *Build) commitIfReady() error {
+	if b.State != "started" {
+		return nil
+	}
+
+	for _, typ := range []string{"patch", "signature"} {
+		bf := b.getFile(typ, "default")
+		if bf == nil || bf.Status != "uploaded" {
+			return nil
+		}
+	}
+
+	archiveFile, err := b.applyPatch()
+	if err != nil {
+		b.State = "failed"
+		return err
+	}
+	b.commit()
+
+	u := b.Store.findUpload(b.UploadID)
+	u.Filename = archiveFile.Filename
+	u.Size = archiveFile.Size
+	return nil
+}
+
+// applyPatch rebuilds the archive of a build pushed with wharf, from
+// its patch and the archive of its parent (or nothing, for the first build).
+// Patches come from clients, so errors applying them aren't fatal.
+func (b *Build) applyPatch() (*BuildFile, error) {
+	s := b.Store
+
+	patchFile := b.getFile("patch", "default")
+	patchCDNFile := s.findCDNFile(patchFile.CDNPath())
+	if patchCDNFile == nil {
+		panic("missing CDN file for patch")
+	}
+
+	pat, err := patcher.New(seeksource.FromBytes(patchCDNFile.Contents), &state.Consumer{})
+	if err != nil {
+		return nil, errors.Wrap(err, "reading patch")
+	}
+
+	targetContainer := pat.GetTargetContainer()
+	var targetPool lake.Pool = nullpool.New(targetContainer)
+	if parentBuild := s.findBuild(b.ParentBuildID); parentBuild != nil {
+		parentArchive := parentBuild.getFile("archive", "default")
+		if parentArchive == nil {
+			panic("parent build is missing an archive")
+		}
+		parentCDNFile := s.findCDNFile(parentArchive.CDNPath())
+		if parentCDNFile == nil {
+			panic("missing CDN file for parent archive")
+		}
+		zr, err := zip.NewReader(bytes.NewReader(parentCDNFile.Contents), parentCDNFile.Size)
+		must(err)
+		targetPool = zippool.New(targetContainer, zr)
+	}
+
+	archiveBuf := new(bytes.Buffer)
+	outputPool, err := zipwriterpool.New(pat.GetSourceContainer(), zip.NewWriter(archiveBuf))
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing archive")
+	}
+
+	bwl, err := bowl.NewPoolBowl(bowl.PoolBowlParams{
+		TargetContainer: targetContainer,
+		TargetPool:      targetPool,
+		SourceContainer: pat.GetSourceContainer(),
+		OutputPool:      outputPool,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "preparing archive")
+	}
+
+	err = pat.Resume(nil, targetPool, bwl)
+	if err != nil {
+		return nil, errors.Wrap(err, "applying patch")
+	}
+	err = bwl.Commit()
+	if err != nil {
+		return nil, errors.Wrap(err, "applying patch")
+	}
+
+	archiveFile := b.makeFile("archive", "default")
+	archiveFile.setHostedContents(fmt.Sprintf("build-%d.zip", b.ID), archiveBuf.Bytes())
+	return archiveFile, nil
 }
 
 func (b *Build) MakeFile(typ string, subtype string) *BuildFile {
+	b.Store.mutex.Lock()
+	defer b.Store.mutex.Unlock()
+	return b.makeFile(typ, subtype)
+}
+
+func (b *Build) makeFile(typ string, subtype string) *BuildFile {
 	s := b.Store
 
 	bf := &BuildFile{
@@ -160,53 +699,126 @@ func (b *Build) MakeFile(typ string, subtype string) *BuildFile {
 		SubType: subtype,
 	}
 	s.BuildFiles[bf.ID] = bf
+	s.indexBuildFile(bf)
 	return bf
 }
 
 func (b *Build) GetFile(typ string, subtype string) *BuildFile {
-	s := b.Store
+	b.Store.mutex.RLock()
+	defer b.Store.mutex.RUnlock()
+	return b.getFile(typ, subtype)
+}
 
-	return s.SelectBuildFile(NoSort(), Eq{
-		"BuildID": b.ID,
-		"Type":    typ,
-		"SubType": subtype,
-	})
+func (b *Build) getFile(typ string, subtype string) *BuildFile {
+	return b.Store.indexes.buildFilesByKey[buildFileKey{
+		BuildID: b.ID,
+		Type:    typ,
+		SubType: subtype,
+	}]
 }
 
 func (u *Upload) SetHostedContents(filename string, contents []byte) {
-	f := u.Store.UploadCDNFile(u.CDNPath(), filename, contents)
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.setHostedContents(filename, contents)
+}
+
+func (u *Upload) setHostedContents(filename string, contents []byte) {
+	f := u.Store.uploadCDNFile(u.CDNPath(), filename, contents)
 	u.Storage = "hosted"
 	u.Filename = filename
 	u.Size = f.Size
+	u.UpdatedAt = f.UploadedAt
 }
 
 func (u *Upload) CDNPath() string {
 	return fmt.Sprintf("/uploads/%d", u.ID)
 }
 
+// CDNFile returns what /uploads/{id}/download ends up serving:
+// the hosted file, or the archive of the head build.
+func (u *Upload) CDNFile() *CDNFile {
+	u.Store.mutex.RLock()
+	defer u.Store.mutex.RUnlock()
+	return u.cdnFile()
+}
+
+func (u *Upload) cdnFile() *CDNFile {
+	s := u.Store
+	switch u.Storage {
+	case "hosted":
+		return s.findCDNFile(u.CDNPath())
+	case "build":
+		build := s.findBuild(u.Head)
+		if build == nil {
+			return nil
+		}
+		archive := build.getFile("archive", "default")
+		if archive == nil {
+			return nil
+		}
+		return s.findCDNFile(archive.CDNPath())
+	default:
+		return nil
+	}
+}
+
+func (bf *BuildFile) CDNFile() *CDNFile {
+	bf.Store.mutex.RLock()
+	defer bf.Store.mutex.RUnlock()
+	return bf.cdnFile()
+}
+
+func (bf *BuildFile) cdnFile() *CDNFile {
+	return bf.Store.findCDNFile(bf.CDNPath())
+}
+
 func (bf *BuildFile) SetHostedContents(filename string, contents []byte) {
-	f := bf.Store.UploadCDNFile(bf.CDNPath(), filename, contents)
+	bf.Store.mutex.Lock()
+	defer bf.Store.mutex.Unlock()
+	bf.setHostedContents(filename, contents)
+}
+
+func (bf *BuildFile) setHostedContents(filename string, contents []byte) {
+	f := bf.Store.uploadCDNFile(bf.CDNPath(), filename, contents)
 	bf.Filename = filename
 	bf.Size = f.Size
+	bf.Status = "uploaded"
 }
 
 func (bf *BuildFile) Sign() *BuildFile {
+	bf.Store.mutex.Lock()
+	defer bf.Store.mutex.Unlock()
+	return bf.sign()
+}
+
+func (bf *BuildFile) sign() *BuildFile {
 	s := bf.Store
 	if bf.Type != "archive" {
 		panic("Can only sign 'archive' BuildFile")
 	}
 
-	b := s.FindBuild(bf.BuildID)
+	b := s.findBuild(bf.BuildID)
 	if b == nil {
 		panic("BuildFile without Build")
 	}
 
-	archiveCDNFile := s.CDNFiles[bf.CDNPath()]
+	archiveCDNFile := s.findCDNFile(bf.CDNPath())
 	if archiveCDNFile == nil {
 		panic("missing CDN File for archive BuildFile")
 	}
 
-	zr, err := zip.NewReader(bytes.NewReader(archiveCDNFile.Contents), archiveCDNFile.Size)
+	signature := signArchive(archiveCDNFile.Contents)
+
+	sf := b.makeFile("signature", "default")
+	filename := fmt.Sprintf("build-%d-signature", b.ID)
+	sf.setHostedContents(filename, signature)
+	return sf
+}
+
+// signArchive computes the wharf signature of a zip file
+func signArchive(archive []byte) []byte {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
 	must(err)
 
 	container, err := tlc.WalkZip(zr, tlc.WalkOpts{})
@@ -244,52 +856,73 @@ func (bf *BuildFile) Sign() *BuildFile {
 	err = sigWire.Close()
 	must(err)
 
-	sf := b.MakeFile("signature", "default")
-	filename := fmt.Sprintf("build-%d-signature", b.ID)
-	sf.SetHostedContents(filename, sigBuf.Bytes())
-	return sf
+	return sigBuf.Bytes()
 }
 
 func (bf *BuildFile) Diff(parentBuild *Build) *BuildFile {
+	bf.Store.mutex.Lock()
+	defer bf.Store.mutex.Unlock()
+	return bf.diff(parentBuild)
+}
+
+func (bf *BuildFile) diff(parentBuild *Build) *BuildFile {
 	s := bf.Store
 	if bf.Type != "archive" {
 		panic("Can only diff 'archive' BuildFile")
 	}
 
-	b := s.FindBuild(bf.BuildID)
+	b := s.findBuild(bf.BuildID)
 	if b == nil {
 		panic("BuildFile without Build")
 	}
 
-	archiveCDNFile := s.CDNFiles[bf.CDNPath()]
+	archiveCDNFile := s.findCDNFile(bf.CDNPath())
 	if archiveCDNFile == nil {
 		panic("missing CDN File for archive BuildFile")
 	}
 
-	sourceZr, err := zip.NewReader(bytes.NewReader(archiveCDNFile.Contents), archiveCDNFile.Size)
-	must(err)
-
-	sourceContainer, err := tlc.WalkZip(sourceZr, tlc.WalkOpts{})
-	must(err)
-
-	parentSig := parentBuild.GetFile("signature", "default")
+	parentSig := parentBuild.getFile("signature", "default")
 	if parentSig == nil {
 		panic("parent build is missing a signature")
 	}
 
-	parentSigCDNFile := s.CDNFiles[parentSig.CDNPath()]
+	parentSigCDNFile := s.findCDNFile(parentSig.CDNPath())
 	if parentSigCDNFile == nil {
 		panic("missing CDN file for parent signature")
 	}
 
-	sigReader := seeksource.FromBytes(parentSigCDNFile.Contents)
-	_, err = sigReader.Resume(nil)
+	patch := diffArchive(archiveCDNFile.Contents, parentSigCDNFile.Contents)
+
+	patchFile := b.makeFile("patch", "default")
+	filename := fmt.Sprintf("patch-%d.pwr", b.ID)
+	patchFile.setHostedContents(filename, patch)
+
+	return patchFile
+}
+
+// diffArchive computes a wharf patch from the build whose signature
+// is given to a zip file. A nil signature stands for an empty build,
+// which is what the first push of a channel is diffed against.
+func diffArchive(archive []byte, signature []byte) []byte {
+	sourceZr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	must(err)
+
+	sourceContainer, err := tlc.WalkZip(sourceZr, tlc.WalkOpts{})
 	must(err)
 
 	ctx := context.Background()
 
-	sigInfo, err := pwr.ReadSignature(ctx, sigReader)
-	must(err)
+	sigInfo := &pwr.SignatureInfo{
+		Container: &tlc.Container{},
+	}
+	if signature != nil {
+		sigReader := seeksource.FromBytes(signature)
+		_, err = sigReader.Resume(nil)
+		must(err)
+
+		sigInfo, err = pwr.ReadSignature(ctx, sigReader)
+		must(err)
+	}
 
 	sourcePool := zippool.New(sourceContainer, sourceZr)
 
@@ -307,11 +940,7 @@ func (bf *BuildFile) Diff(parentBuild *Build) *BuildFile {
 	err = dctx.WritePatch(ctx, patchBuf, ioutil.Discard)
 	must(err)
 
-	patchFile := b.MakeFile("patch", "default")
-	filename := fmt.Sprintf("patch-%d.pwr", b.ID)
-	patchFile.SetHostedContents(filename, patchBuf.Bytes())
-
-	return patchFile
+	return patchBuf.Bytes()
 }
 
 func compressionSettings() pwr.CompressionSettings {
@@ -324,12 +953,176 @@ func (b *BuildFile) CDNPath() string {
 	return fmt.Sprintf("/build-files/%d", b.ID)
 }
 
+func (s *Store) DeleteAPIKey(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteAPIKey(id)
+}
+
+func (s *Store) deleteAPIKey(id int64) bool {
+	apiKey := s.APIKeys[id]
+	if apiKey == nil {
+		return false
+	}
+	delete(s.APIKeys, id)
+	s.unindexAPIKey(apiKey)
+	return true
+}
+
+// RevokeAPIKey deletes the API key with the given key string, if any.
+func (s *Store) RevokeAPIKey(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	apiKey := s.findAPIKeyByKey(key)
+	if apiKey == nil {
+		return false
+	}
+	return s.deleteAPIKey(apiKey.ID)
+}
+
+func (s *Store) DeleteGameAdmin(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteGameAdmin(id)
+}
+
+func (s *Store) deleteGameAdmin(id int64) bool {
+	admin := s.GameAdmins[id]
+	if admin == nil {
+		return false
+	}
+	delete(s.GameAdmins, id)
+	s.unindexGameAdmin(admin)
+	return true
+}
+
+// DeleteGame removes a game along with everything that refers to it:
+// its uploads (see DeleteUpload), admins, sessions, download keys,
+// sales, and its entries in collections.
+func (s *Store) DeleteGame(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteGame(id)
+}
+
+func (s *Store) deleteGame(id int64) bool {
+	if s.Games[id] == nil {
+		return false
+	}
+
+	for _, u := range s.listUploadsByGame(id) {
+		s.deleteUpload(u.ID)
+	}
+	for _, a := range s.listGameAdminsByGame(id) {
+		s.deleteGameAdmin(a.ID)
+	}
+	for _, ugs := range from(s.UserGameSessions).Where(func(ugs *UserGameSession) bool { return ugs.GameID == id }).All() {
+		delete(s.UserGameSessions, ugs.ID)
+	}
+	for _, dk := range from(s.DownloadKeys).Where(func(dk *DownloadKey) bool { return dk.GameID == id }).All() {
+		delete(s.DownloadKeys, dk.ID)
+	}
+	for _, sale := range from(s.Sales).Where(func(sale *Sale) bool { return sale.GameID == id }).All() {
+		delete(s.Sales, sale.ID)
+	}
+	for _, cg := range from(s.CollectionGames).Where(func(cg *CollectionGame) bool { return cg.GameID == id }).All() {
+		delete(s.CollectionGames, cg.ID)
+	}
+	delete(s.Games, id)
+	return true
+}
+
+// DeleteUpload removes an upload, its hosted file,
+// and its builds (see DeleteBuild).
+func (s *Store) DeleteUpload(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteUpload(id)
+}
+
+func (s *Store) deleteUpload(id int64) bool {
+	upload := s.Uploads[id]
+	if upload == nil {
+		return false
+	}
+
+	for _, b := range s.listBuildsByUpload(id) {
+		s.deleteBuild(b.ID)
+	}
+	delete(s.CDNFiles, upload.CDNPath())
+	delete(s.Uploads, id)
+	s.unindexUpload(upload)
+	return true
+}
+
+// DeleteBuild removes a build, its build files and their CDN files.
+// If it was the head of its upload, the latest completed build
+// left takes its place.
+func (s *Store) DeleteBuild(id int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.deleteBuild(id)
+}
+
+func (s *Store) deleteBuild(id int64) bool {
+	build := s.Builds[id]
+	if build == nil {
+		return false
+	}
+
+	for _, bf := range s.listBuildFilesByBuild(id) {
+		delete(s.CDNFiles, bf.CDNPath())
+		delete(s.BuildFiles, bf.ID)
+		s.unindexBuildFile(bf)
+	}
+	delete(s.Builds, id)
+	s.unindexBuild(build)
+
+	// the upload now serves the latest build that's left, or nothing
+	upload := s.findUpload(build.UploadID)
+	if upload != nil && upload.Head == id {
+		upload.Head = 0
+		upload.Storage = ""
+		upload.Filename = ""
+		upload.Size = 0
+		for _, b := range s.listBuildsByUpload(upload.ID) {
+			if b.State != "completed" {
+				continue
+			}
+			upload.Head = b.ID
+			upload.Storage = "build"
+			if archive := b.getFile("archive", "default"); archive != nil {
+				upload.Filename = archive.Filename
+				upload.Size = archive.Size
+			}
+			break
+		}
+		upload.UpdatedAt = time.Now().UTC()
+	}
+	return true
+}
+
 func (s *Store) UploadCDNFile(path string, filename string, contents []byte) *CDNFile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.uploadCDNFile(path, filename, contents)
+}
+
+// uploadCDNFile always makes a new CDNFile rather than updating the
+// existing one, so /@cdn can keep serving a file without the lock.
+func (s *Store) uploadCDNFile(path string, filename string, contents []byte) *CDNFile {
+	md5Sum := md5.Sum(contents)
+	sha256Sum := sha256.Sum256(contents)
 	f := &CDNFile{
 		Path:     path,
 		Filename: filename,
 		Size:     int64(len(contents)),
 		Contents: contents,
+
+		MD5:        hex.EncodeToString(md5Sum[:]),
+		SHA256:     hex.EncodeToString(sha256Sum[:]),
+		UploadedAt: time.Now().UTC(),
 	}
 	s.CDNFiles[path] = f
 	return f
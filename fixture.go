@@ -0,0 +1,335 @@
+package mitch
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Fixture describes a set of objects to seed a store with. It's read
+// from YAML (or JSON, which is valid YAML) by Store.LoadFixture, for
+// test suites that can't call the Go factory methods directly:
+//
+//	users:
+//	  - name: Some Developer
+//	    developer: true
+//	    api_keys: [dev-key]
+//	    oauth_apps:
+//	      - name: Some App
+//	        redirect_uri: http://localhost:8080/callback
+//	        client_id: some-app
+//	        client_secret: some-secret
+//	    games:
+//	      - title: Some Game
+//	        published: true
+//	        admins: [Some Admin]
+//	        uploads:
+//	          - channel: windows
+//	            platforms: [windows]
+//	            builds:
+//	              - entries:
+//	                  - path: hello.txt
+//	                    string: Just a test file
+//	                  - path: data.bin
+//	                    random: {seed: 1, size: 4096}
+//	  - name: Some Admin
+type Fixture struct {
+	Users []*FixtureUser `yaml:"users"`
+}
+
+type FixtureUser struct {
+	Name           string             `yaml:"name"`
+	Developer      bool               `yaml:"developer"`
+	PressUser      bool               `yaml:"press_user"`
+	AllowTelemetry bool               `yaml:"allow_telemetry"`
+	Password       string             `yaml:"password"`
+	TOTPSecret     string             `yaml:"totp_secret"`
+	Recaptcha      bool               `yaml:"recaptcha"`
+	APIKeys        []string           `yaml:"api_keys"`
+	OAuthApps      []*FixtureOAuthApp `yaml:"oauth_apps"`
+	Games          []*FixtureGame     `yaml:"games"`
+}
+
+// FixtureOAuthApp gets a random client ID and secret unless they're given
+type FixtureOAuthApp struct {
+	Name         string `yaml:"name"`
+	RedirectURI  string `yaml:"redirect_uri"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	AutoDeny     bool   `yaml:"auto_deny"`
+}
+
+type FixtureGame struct {
+	Title          string           `yaml:"title"`
+	Type           string           `yaml:"type"`
+	Classification string           `yaml:"classification"`
+	MinPrice       int64            `yaml:"min_price"`
+	ShortText      string           `yaml:"short_text"`
+	CoverURL       string           `yaml:"cover_url"`
+	Platforms      []string         `yaml:"platforms"`
+	Published      bool             `yaml:"published"`
+	ViewsCount     int64            `yaml:"views_count"`
+	DownloadsCount int64            `yaml:"downloads_count"`
+	PurchasesCount int64            `yaml:"purchases_count"`
+	Admins         []string         `yaml:"admins"`
+	Uploads        []*FixtureUpload `yaml:"uploads"`
+}
+
+type FixtureUpload struct {
+	Title     string   `yaml:"title"`
+	Channel   string   `yaml:"channel"`
+	Platforms []string `yaml:"platforms"`
+	Demo      bool     `yaml:"demo"`
+	Preorder  bool     `yaml:"preorder"`
+	Hidden    bool     `yaml:"hidden"`
+
+	// Entries of a zip file hosted directly on the upload
+	Entries []*FixtureEntry `yaml:"entries"`
+	// Pushed in order, each one is a patch from the previous one
+	Builds []*FixtureBuild `yaml:"builds"`
+}
+
+type FixtureBuild struct {
+	Entries []*FixtureEntry `yaml:"entries"`
+}
+
+// FixtureEntry is a single file in an archive, its contents are
+// the concatenation of String, Random and Chunks (in that order).
+type FixtureEntry struct {
+	Path   string  `yaml:"path"`
+	String string  `yaml:"string"`
+	Random *Chunk  `yaml:"random"`
+	Chunks []Chunk `yaml:"chunks"`
+}
+
+// LoadFixture reads a fixture and creates everything it describes.
+func (s *Store) LoadFixture(r io.Reader) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loadFixture(r)
+}
+
+func (s *Store) loadFixture(r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var fixture Fixture
+	err = yaml.UnmarshalStrict(payload, &fixture)
+	if err != nil {
+		return errors.Wrap(err, "parsing fixture")
+	}
+
+	return s.applyFixture(&fixture)
+}
+
+// ApplyFixture creates every object described by a fixture.
+func (s *Store) ApplyFixture(fixture *Fixture) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.applyFixture(fixture)
+}
+
+func (s *Store) applyFixture(fixture *Fixture) error {
+	// nothing gets created unless the whole fixture is valid
+	err := s.validateFixture(fixture)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*User)
+	for _, fu := range fixture.Users {
+		u := s.makeUser(fu.Name)
+		u.Developer = fu.Developer
+		u.PressUser = fu.PressUser
+		u.AllowTelemetry = fu.AllowTelemetry
+		if fu.Password != "" {
+			u.setPassword(fu.Password)
+		}
+		if fu.TOTPSecret != "" {
+			u.setTOTPSecret(fu.TOTPSecret)
+		}
+		if fu.Recaptcha {
+			u.RecaptchaNeeded = true
+		}
+		for _, key := range fu.APIKeys {
+			if key == "" {
+				key = uuid.New().String()
+			}
+			u.makeAPIKey(key)
+		}
+		for _, fa := range fu.OAuthApps {
+			app := u.makeOAuthApp(fa.Name, fa.RedirectURI)
+			if fa.ClientID != "" {
+				app.ClientID = fa.ClientID
+			}
+			if fa.ClientSecret != "" {
+				app.ClientSecret = fa.ClientSecret
+			}
+			app.AutoDeny = fa.AutoDeny
+		}
+		users[u.DisplayName] = u
+		users[u.Username] = u
+	}
+
+	for _, fu := range fixture.Users {
+		u := users[fu.Name]
+		for _, fg := range fu.Games {
+			u.applyFixtureGame(fg, users)
+		}
+	}
+	return nil
+}
+
+// validateFixture checks everything that could make
+// applyFixture fail halfway through.
+func (s *Store) validateFixture(fixture *Fixture) error {
+	// users are looked up by name and username, so those must be unique,
+	// api keys by key, and apps by client ID
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+	clientIDs := make(map[string]bool)
+	for _, fu := range fixture.Users {
+		if fu.Name == "" {
+			return errors.New("fixture user is missing a name")
+		}
+		username := s.slugify(fu.Name)
+		if names[fu.Name] || names[username] || s.findUserByUsername(username) != nil {
+			return errors.Errorf("duplicate user %q", fu.Name)
+		}
+		names[fu.Name] = true
+		names[username] = true
+
+		if fu.TOTPSecret != "" {
+			if _, err := decodeTOTPSecret(fu.TOTPSecret); err != nil {
+				return errors.Wrapf(err, "in user %q", fu.Name)
+			}
+		}
+
+		for _, key := range fu.APIKeys {
+			if key == "" {
+				continue
+			}
+			if keys[key] || s.findAPIKeyByKey(key) != nil {
+				return errors.Errorf("duplicate api key in user %q", fu.Name)
+			}
+			keys[key] = true
+		}
+
+		for _, fa := range fu.OAuthApps {
+			if fa.Name == "" {
+				return errors.Errorf("oauth app of user %q is missing a name", fu.Name)
+			}
+			if fa.ClientID == "" {
+				continue
+			}
+			if clientIDs[fa.ClientID] || s.findOAuthAppByClientID(fa.ClientID) != nil {
+				return errors.Errorf("duplicate oauth app client_id %q", fa.ClientID)
+			}
+			clientIDs[fa.ClientID] = true
+		}
+	}
+
+	for _, fu := range fixture.Users {
+		for _, fg := range fu.Games {
+			err := validateFixtureGame(fg, names)
+			if err != nil {
+				return errors.Wrapf(err, "in game %q of user %q", fg.Title, fu.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func validateFixtureGame(fg *FixtureGame, users map[string]bool) error {
+	var windows, linux, mac bool
+	err := parsePlatforms(fg.Platforms, &windows, &linux, &mac)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range fg.Admins {
+		if !users[name] {
+			return errors.Errorf("unknown admin %q", name)
+		}
+	}
+
+	for _, fup := range fg.Uploads {
+		err := parsePlatforms(fup.Platforms, &windows, &linux, &mac)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFixtureGame expects fg to have gone through validateFixtureGame
+func (u *User) applyFixtureGame(fg *FixtureGame, users map[string]*User) {
+	g := u.makeGame(fg.Title)
+	if fg.Type != "" {
+		g.Type = fg.Type
+	}
+	if fg.Classification != "" {
+		g.Classification = fg.Classification
+	}
+	g.MinPrice = fg.MinPrice
+	g.ShortText = fg.ShortText
+	if fg.CoverURL != "" {
+		g.setCover(fg.CoverURL, fg.CoverURL)
+	}
+	must(g.setPlatforms(fg.Platforms))
+	if fg.Published {
+		g.publish()
+	}
+	g.setStats(fg.ViewsCount, fg.DownloadsCount, fg.PurchasesCount)
+
+	for _, name := range fg.Admins {
+		g.addAdmin(users[name])
+	}
+
+	for _, fup := range fg.Uploads {
+		up := g.makeUpload(fup.Title)
+		up.ChannelName = fup.Channel
+		up.Demo = fup.Demo
+		up.Preorder = fup.Preorder
+		up.Hidden = fup.Hidden
+		must(up.setPlatforms(fup.Platforms))
+
+		if len(fup.Entries) > 0 {
+			up.setZipContentsCustom(func(ac *ArchiveContext) {
+				ac.applyFixtureEntries(fup.Entries)
+			})
+		}
+		for _, fb := range fup.Builds {
+			up.applyFixtureBuild(fb)
+		}
+	}
+}
+
+// ApplyFixtureBuild pushes a build with the entries described by fb.
+func (up *Upload) ApplyFixtureBuild(fb *FixtureBuild) *Build {
+	up.Store.mutex.Lock()
+	defer up.Store.mutex.Unlock()
+	return up.applyFixtureBuild(fb)
+}
+
+func (up *Upload) applyFixtureBuild(fb *FixtureBuild) *Build {
+	return up.pushBuild(func(ac *ArchiveContext) {
+		ac.applyFixtureEntries(fb.Entries)
+	})
+}
+
+func (ac *ArchiveContext) applyFixtureEntries(entries []*FixtureEntry) {
+	for _, fe := range entries {
+		e := ac.Entry(fe.Path)
+		e.String(fe.String)
+		if fe.Random != nil {
+			e.Random(fe.Random.Seed, fe.Random.Size)
+		}
+		e.Chunks(fe.Chunks)
+	}
+}
@@ -0,0 +1,100 @@
+package mitch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFixture = `
+users:
+  - name: Some Developer
+    developer: true
+    api_keys: [dev-key]
+    oauth_apps:
+      - name: Some App
+        client_id: some-app
+        client_secret: some-secret
+    games:
+      - title: Some Game
+        published: true
+        admins: [Some Admin]
+        uploads:
+          - channel: windows
+            platforms: [windows]
+            builds:
+              - entries:
+                  - path: hello.txt
+                    string: Just a test file
+              - entries:
+                  - path: hello.txt
+                    string: Just a test file
+                  - path: data.bin
+                    random: {seed: 1, size: 4096}
+  - name: Some Admin
+`
+
+func Test_LoadFixture(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	assert.NoError(s.LoadFixture(strings.NewReader(testFixture)))
+
+	apiKey := s.FindAPIKeysByKey("dev-key")
+	assert.NotNil(apiKey)
+	dev := s.FindUser(apiKey.UserID)
+	assert.EqualValues("Some Developer", dev.DisplayName)
+	assert.True(dev.Developer)
+
+	app := s.FindOAuthAppByClientID("some-app")
+	if assert.NotNil(app) {
+		assert.EqualValues(dev.ID, app.UserID)
+		assert.EqualValues("some-secret", app.ClientSecret)
+	}
+
+	games := Select(s, s.Games).Where(Eq(func(g *Game) int64 { return g.UserID }, dev.ID)).All()
+	assert.EqualValues(1, len(games))
+	game := games[0]
+	assert.True(game.Published)
+
+	admins := s.ListGameAdminsByGame(game.ID)
+	assert.EqualValues(1, len(admins))
+	assert.EqualValues("Some Admin", s.FindUser(admins[0].UserID).DisplayName)
+
+	upload := s.FindUploadByChannel(game.ID, "windows")
+	assert.NotNil(upload)
+	assert.True(upload.PlatformWindows)
+	assert.False(upload.PlatformLinux)
+
+	formatted := FormatGame(game)
+	assert.EqualValues([]string{"p_windows"}, formatted["traits"])
+
+	head := s.FindBuild(upload.Head)
+	assert.EqualValues(2, head.Version)
+	assert.NotNil(head.GetFile("patch", "default"))
+
+	err := s.LoadFixture(strings.NewReader("users: [{name: Lonely, games: [{title: G, admins: [Nobody]}]}]"))
+	assert.Error(err)
+	assert.Nil(s.FindUserByUsername("lonely"), "invalid fixtures don't create anything")
+
+	err = s.LoadFixture(strings.NewReader("users: [{name: Lonely, games: [{title: G, uploads: [{platforms: [amiga]}]}]}]"))
+	assert.Error(err)
+	assert.Nil(s.FindUserByUsername("lonely"), "invalid fixtures don't create anything")
+
+	err = newStore().LoadFixture(strings.NewReader("users: [{name: Twin}, {name: Twin}]"))
+	assert.Error(err)
+	err = newStore().LoadFixture(strings.NewReader("users: [{name: Some Twin}, {name: some-twin}]"))
+	assert.Error(err)
+	err = s.LoadFixture(strings.NewReader("users: [{name: Some Admin}]"))
+	assert.Error(err)
+	err = s.LoadFixture(strings.NewReader("users: [{name: Copycat, oauth_apps: [{name: Copy, client_id: some-app}]}]"))
+	assert.Error(err)
+	assert.Nil(s.FindUserByUsername("copycat"))
+	err = s.LoadFixture(strings.NewReader("users: [{name: Other, api_keys: [dev-key]}]"))
+	assert.Error(err)
+	assert.Nil(s.FindUserByUsername("other"))
+	assert.EqualValues(dev.ID, s.FindAPIKeysByKey("dev-key").UserID)
+	err = newStore().LoadFixture(strings.NewReader("users: [{name: One, api_keys: [same]}, {name: Two, api_keys: [same]}]"))
+	assert.Error(err)
+}
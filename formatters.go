@@ -19,45 +19,234 @@ func FormatUser(user *User) Any {
 	return res
 }
 
+func FormatAPIKey(apiKey *APIKey) Any {
+	res := Any{
+		"id":         apiKey.ID,
+		"user_id":    apiKey.UserID,
+		"key":        apiKey.Key,
+		"created_at": apiKey.CreatedAt,
+		"updated_at": apiKey.UpdatedAt,
+	}
+	if len(apiKey.Scopes) > 0 {
+		res["scopes"] = apiKey.Scopes
+	}
+	if !apiKey.ExpiresAt.IsZero() {
+		res["expires_at"] = apiKey.ExpiresAt
+	}
+	return res
+}
+
+func FormatAPIKeys(apiKeys []*APIKey) []Any {
+	res := []Any{}
+	for _, k := range apiKeys {
+		res = append(res, FormatAPIKey(k))
+	}
+	return res
+}
+
 func FormatUserGameSession(s *UserGameSession) Any {
 	return Any{
 		"id":          s.ID,
 		"game_id":     s.GameID,
 		"user_id":     s.UserID,
-		"seconds_run": 0,
-		"last_run_at": time.Now(),
+		"seconds_run": s.SecondsRun,
+		"last_run_at": s.LastRunAt,
 		"crashed":     s.Crashed,
+		"created_at":  s.CreatedAt,
+		"updated_at":  s.UpdatedAt,
 	}
 }
 
-func FormatUserGameSummary() Any {
-	return Any{
-		"seconds_run": 0,
-		"last_run_at": time.Now(),
+// FormatUserGameSummary aggregates all the sessions of a user for a game
+func FormatUserGameSummary(sessions []*UserGameSession) Any {
+	var secondsRun int64
+	var lastRunAt time.Time
+	for _, s := range sessions {
+		secondsRun += s.SecondsRun
+		if s.LastRunAt.After(lastRunAt) {
+			lastRunAt = s.LastRunAt
+		}
 	}
+
+	res := Any{
+		"seconds_run": secondsRun,
+	}
+	if !lastRunAt.IsZero() {
+		res["last_run_at"] = lastRunAt
+	}
+	return res
 }
 
 func FormatGame(game *Game) Any {
 	res := Any{
-		"id":             game.ID,
-		"user_id":        game.UserID,
-		"title":          game.Title,
-		"min_price":      game.MinPrice,
-		"type":           game.Type,
-		"classification": game.Classification,
+		"id":              game.ID,
+		"user_id":         game.UserID,
+		"url":             game.URL,
+		"title":           game.Title,
+		"short_text":      game.ShortText,
+		"min_price":       game.MinPrice,
+		"type":            game.Type,
+		"classification":  game.Classification,
+		"created_at":      game.CreatedAt,
+		"can_be_bought":   game.CanBeBought,
+		"has_demo":        game.HasDemo,
+		"in_press_system": game.InPressSystem,
+		"traits":          formatGameTraits(game),
+	}
+	if game.CoverURL != "" {
+		res["cover_url"] = game.CoverURL
+	}
+	if game.StillCoverURL != "" {
+		res["still_cover_url"] = game.StillCoverURL
+	}
+	if game.Published {
+		res["published_at"] = game.PublishedAt
+	}
+	if user := game.Store.findUser(game.UserID); user != nil {
+		res["user"] = FormatUser(user)
+	}
+	if sale := game.Store.findActiveSaleByGame(game.ID); sale != nil {
+		res["sale"] = FormatSale(sale)
+	}
+	if game.Embed != nil {
+		res["embed"] = Any{
+			"width":      game.Embed.Width,
+			"height":     game.Embed.Height,
+			"fullscreen": game.Embed.Fullscreen,
+		}
+	}
+	return res
+}
+
+func FormatSale(sale *Sale) Any {
+	return Any{
+		"id":         sale.ID,
+		"rate":       sale.Rate,
+		"start_date": sale.StartDate,
+		"end_date":   sale.EndDate,
+	}
+}
+
+// formatGameTraits lists the platforms of a game and of its
+// uploads, along with its boolean flags, like the API does.
+func formatGameTraits(game *Game) []string {
+	windows, linux, mac := game.PlatformWindows, game.PlatformLinux, game.PlatformMac
+	for _, u := range game.Store.listUploadsByGame(game.ID) {
+		windows = windows || u.PlatformWindows
+		linux = linux || u.PlatformLinux
+		mac = mac || u.PlatformMac
+	}
+
+	traits := []string{}
+	if windows {
+		traits = append(traits, "p_windows")
+	}
+	if linux {
+		traits = append(traits, "p_linux")
+	}
+	if mac {
+		traits = append(traits, "p_osx")
+	}
+	if game.CanBeBought {
+		traits = append(traits, "can_be_bought")
+	}
+	if game.HasDemo {
+		traits = append(traits, "has_demo")
+	}
+	if game.InPressSystem {
+		traits = append(traits, "in_press_system")
+	}
+	return traits
+}
+
+// FormatProfileGame includes the fields only the game's
+// editors get to see
+func FormatProfileGame(game *Game) Any {
+	res := FormatGame(game)
+	res["published"] = game.Published
+	res["views_count"] = game.ViewsCount
+	res["downloads_count"] = game.DownloadsCount
+	res["purchases_count"] = game.PurchasesCount
+	return res
+}
+
+func FormatProfileGames(games []*Game) []Any {
+	res := []Any{}
+	for _, g := range games {
+		res = append(res, FormatProfileGame(g))
+	}
+	return res
+}
+
+func FormatGames(games []*Game) []Any {
+	res := []Any{}
+	for _, g := range games {
+		res = append(res, FormatGame(g))
+	}
+	return res
+}
+
+func FormatUsers(users []*User) []Any {
+	res := []Any{}
+	for _, u := range users {
+		res = append(res, FormatUser(u))
+	}
+	return res
+}
+
+func FormatCollection(c *Collection) Any {
+	return Any{
+		"id":          c.ID,
+		"title":       c.Title,
+		"created_at":  c.CreatedAt,
+		"updated_at":  c.UpdatedAt,
+		"games_count": len(c.Store.listCollectionGamesByCollection(c.ID)),
+	}
+}
+
+func FormatCollections(collections []*Collection) []Any {
+	res := []Any{}
+	for _, c := range collections {
+		res = append(res, FormatCollection(c))
+	}
+	return res
+}
+
+func FormatCollectionGame(cg *CollectionGame) Any {
+	res := Any{
+		"position":   cg.Position,
+		"user_id":    cg.UserID,
+		"created_at": cg.CreatedAt,
+	}
+	if game := cg.Store.findGame(cg.GameID); game != nil {
+		res["game"] = FormatGame(game)
+	}
+	return res
+}
+
+func FormatCollectionGames(cgs []*CollectionGame) []Any {
+	res := []Any{}
+	for _, cg := range cgs {
+		res = append(res, FormatCollectionGame(cg))
 	}
 	return res
 }
 
 func FormatUpload(upload *Upload) Any {
 	res := Any{
-		"id":       upload.ID,
-		"game_id":  upload.GameID,
-		"type":     upload.Type,
-		"storage":  upload.Storage,
-		"size":     upload.Size,
-		"filename": upload.Filename,
-		"url":      upload.URL,
+		"id":           upload.ID,
+		"game_id":      upload.GameID,
+		"display_name": upload.DisplayName,
+		"type":         upload.Type,
+		"storage":      upload.Storage,
+		"size":         upload.Size,
+		"filename":     upload.Filename,
+		"url":          upload.URL,
+		"demo":         upload.Demo,
+		"preorder":     upload.Preorder,
+		"hidden":       upload.Hidden,
+		"created_at":   upload.CreatedAt,
+		"updated_at":   upload.UpdatedAt,
 	}
 	platforms := Any{}
 	if upload.PlatformLinux {
@@ -71,11 +260,16 @@ func FormatUpload(upload *Upload) Any {
 	}
 	res["platforms"] = platforms
 
-	build := upload.Store.FindBuild(upload.Head)
+	build := upload.Store.findBuild(upload.Head)
 	if build != nil {
+		res["build_id"] = build.ID
 		res["build"] = FormatBuild(build)
 		res["channel_name"] = upload.ChannelName
 	}
+	formatHashes(res, upload.cdnFile())
+	if upload.MD5Hash != "" {
+		res["md5_hash"] = upload.MD5Hash
+	}
 
 	return res
 }
@@ -94,6 +288,8 @@ func FormatBuild(build *Build) Any {
 		"parent_build_id": build.ParentBuildID,
 		"upload_id":       build.UploadID,
 		"version":         build.Version,
+		"user_version":    build.UserVersion,
+		"state":           build.State,
 	}
 	return res
 }
@@ -108,9 +304,73 @@ func FormatBuilds(builds []*Build) []Any {
 
 func FormatBuildFile(bf *BuildFile) Any {
 	res := Any{
+		"id":       bf.ID,
+		"state":    bf.Status,
 		"size":     bf.Size,
 		"type":     bf.Type,
 		"sub_type": bf.SubType,
 	}
+	formatHashes(res, bf.cdnFile())
+	return res
+}
+
+func formatHashes(res Any, f *CDNFile) {
+	if f == nil || f.MD5 == "" {
+		return
+	}
+	res["md5_hash"] = f.MD5
+	res["sha256_hash"] = f.SHA256
+}
+
+func FormatBuildFiles(files []*BuildFile) []Any {
+	var res []Any
+	for _, bf := range files {
+		res = append(res, FormatBuildFile(bf))
+	}
+	return res
+}
+
+func FormatChannel(upload *Upload) Any {
+	s := upload.Store
+	res := Any{
+		"name":   upload.ChannelName,
+		"tags":   upload.ChannelName,
+		"upload": FormatUpload(upload),
+	}
+
+	if head := s.findBuild(upload.Head); head != nil {
+		res["head"] = FormatBuild(head)
+	}
+	for _, b := range s.listBuildsByUpload(upload.ID) {
+		if b.ID <= upload.Head {
+			break
+		}
+		if b.State != "completed" && b.State != "failed" {
+			res["pending"] = FormatBuild(b)
+			break
+		}
+	}
+	return res
+}
+
+func FormatDownloadKey(dk *DownloadKey) Any {
+	res := Any{
+		"id":         dk.ID,
+		"game_id":    dk.GameID,
+		"owner_id":   dk.OwnerID,
+		"created_at": dk.CreatedAt,
+		"updated_at": dk.CreatedAt,
+	}
+	if game := dk.Store.findGame(dk.GameID); game != nil {
+		res["game"] = FormatGame(game)
+	}
+	return res
+}
+
+func FormatDownloadKeys(dks []*DownloadKey) []Any {
+	res := []Any{}
+	for _, dk := range dks {
+		res = append(res, FormatDownloadKey(dk))
+	}
 	return res
 }
@@ -0,0 +1,119 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FormatGame(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Some Developer")
+	apiKey := dev.MakeAPIKey().Key
+	before := time.Now().UTC().Add(-time.Second)
+
+	game := dev.MakeGame("My Cool Game!")
+	getGame := func() map[string]interface{} {
+		status, payload := apiRequest(t, srv, "GET", fmt.Sprintf("/games/%d", game.ID), apiKey, nil)
+		assert.EqualValues(200, status)
+		return payload["game"].(map[string]interface{})
+	}
+	parseTime := func(value interface{}) time.Time {
+		res, err := time.Parse(time.RFC3339, value.(string))
+		assert.NoError(err)
+		return res
+	}
+
+	formatted := getGame()
+	assert.EqualValues("https://some-developer.itch.io/my-cool-game", formatted["url"])
+	createdAt := parseTime(formatted["created_at"])
+	assert.True(createdAt.After(before))
+	assert.Nil(formatted["published_at"], "drafts have no published_at")
+	assert.Nil(formatted["embed"])
+	assert.Nil(formatted["cover_url"])
+	assert.Nil(formatted["still_cover_url"])
+
+	game.Publish()
+	game.SetCover("https://example.org/cover.gif", "https://example.org/cover.png")
+	game.SetEmbed(640, 480, true)
+
+	formatted = getGame()
+	assert.EqualValues(createdAt, parseTime(formatted["created_at"]))
+	publishedAt := parseTime(formatted["published_at"])
+	assert.False(publishedAt.Before(createdAt))
+	assert.EqualValues("https://example.org/cover.gif", formatted["cover_url"])
+	assert.EqualValues("https://example.org/cover.png", formatted["still_cover_url"])
+	assert.EqualValues("html", formatted["type"])
+	assert.EqualValues(map[string]interface{}{
+		"width":      float64(640),
+		"height":     float64(480),
+		"fullscreen": true,
+	}, formatted["embed"])
+
+	game.Unpublish()
+	assert.Nil(getGame()["published_at"])
+}
+
+func Test_FormatProfileGames(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Some Developer")
+	apiKey := dev.MakeAPIKey().Key
+	published := dev.MakeGame("Published Game")
+	published.Publish()
+	published.SetStats(1200, 340, 56)
+	draft := dev.MakeGame("Draft Game")
+
+	other := store.MakeUser("Other Developer")
+	other.MakeGame("Not Mine").Publish()
+	shared := other.MakeGame("Shared Game")
+	shared.AddAdmin(dev)
+	shared.SetStats(7, 8, 9)
+
+	status, payload := apiRequest(t, srv, "GET", "/profile/games", apiKey, nil)
+	assert.EqualValues(200, status)
+	games := payload["games"].([]interface{})
+	if assert.Len(games, 3, "games the user is an admin of are listed too") {
+		formatted := games[0].(map[string]interface{})
+		assert.EqualValues(published.ID, formatted["id"])
+		assert.EqualValues("Published Game", formatted["title"])
+		assert.EqualValues(true, formatted["published"])
+		assert.EqualValues(1200, formatted["views_count"])
+		assert.EqualValues(340, formatted["downloads_count"])
+		assert.EqualValues(56, formatted["purchases_count"])
+
+		formatted = games[1].(map[string]interface{})
+		assert.EqualValues(draft.ID, formatted["id"])
+		assert.EqualValues(false, formatted["published"])
+		assert.EqualValues(0, formatted["views_count"])
+		assert.EqualValues(0, formatted["downloads_count"])
+		assert.EqualValues(0, formatted["purchases_count"])
+
+		formatted = games[2].(map[string]interface{})
+		assert.EqualValues(shared.ID, formatted["id"])
+		assert.EqualValues(7, formatted["views_count"])
+		assert.EqualValues(8, formatted["downloads_count"])
+		assert.EqualValues(9, formatted["purchases_count"])
+	}
+
+	status, _ = apiRequest(t, srv, "GET", "/profile/games", dev.MakeAPIKeyWithScopes([]string{"profile:me"}, 0).Key, nil)
+	assert.EqualValues(403, status)
+	status, _ = apiRequest(t, srv, "GET", "/profile/games", dev.MakeAPIKeyWithScopes([]string{"profile:games"}, 0).Key, nil)
+	assert.EqualValues(200, status)
+}
@@ -0,0 +1,110 @@
+package mitch
+
+// indexes speed up the lookups done on (nearly) every request.
+// The factory methods keep them up to date, and reindex rebuilds
+// them from the tables, for stores loaded from a snapshot.
+type indexes struct {
+	apiKeysByKey     map[string]*APIKey
+	uploadsByGame    map[int64][]*Upload
+	buildsByUpload   map[int64][]*Build
+	buildFilesByKey  map[buildFileKey]*BuildFile
+	gameAdminsByGame map[int64][]*GameAdmin
+}
+
+type buildFileKey struct {
+	BuildID int64
+	Type    string
+	SubType string
+}
+
+func (s *Store) reindex() {
+	s.indexes = indexes{
+		apiKeysByKey:     make(map[string]*APIKey),
+		uploadsByGame:    make(map[int64][]*Upload),
+		buildsByUpload:   make(map[int64][]*Build),
+		buildFilesByKey:  make(map[buildFileKey]*BuildFile),
+		gameAdminsByGame: make(map[int64][]*GameAdmin),
+	}
+
+	// tables are maps, insert in ID order so the lists
+	// come out the same as when the factories fill them.
+	for _, k := range from(s.APIKeys).OrderBy(Asc(func(k *APIKey) int64 { return k.ID })).All() {
+		s.indexAPIKey(k)
+	}
+	for _, u := range from(s.Uploads).OrderBy(Asc(func(u *Upload) int64 { return u.ID })).All() {
+		s.indexUpload(u)
+	}
+	for _, b := range from(s.Builds).OrderBy(Asc(func(b *Build) int64 { return b.ID })).All() {
+		s.indexBuild(b)
+	}
+	for _, bf := range from(s.BuildFiles).OrderBy(Asc(func(bf *BuildFile) int64 { return bf.ID })).All() {
+		s.indexBuildFile(bf)
+	}
+	for _, a := range from(s.GameAdmins).OrderBy(Asc(func(a *GameAdmin) int64 { return a.ID })).All() {
+		s.indexGameAdmin(a)
+	}
+}
+
+func (s *Store) indexAPIKey(k *APIKey) {
+	s.indexes.apiKeysByKey[k.Key] = k
+}
+
+func (s *Store) unindexAPIKey(k *APIKey) {
+	if s.indexes.apiKeysByKey[k.Key] == k {
+		delete(s.indexes.apiKeysByKey, k.Key)
+	}
+}
+
+func (s *Store) indexUpload(u *Upload) {
+	s.indexes.uploadsByGame[u.GameID] = append(s.indexes.uploadsByGame[u.GameID], u)
+}
+
+func (s *Store) unindexUpload(u *Upload) {
+	s.indexes.uploadsByGame[u.GameID] = without(s.indexes.uploadsByGame[u.GameID], u)
+}
+
+func (s *Store) indexBuild(b *Build) {
+	s.indexes.buildsByUpload[b.UploadID] = append(s.indexes.buildsByUpload[b.UploadID], b)
+}
+
+func (s *Store) unindexBuild(b *Build) {
+	s.indexes.buildsByUpload[b.UploadID] = without(s.indexes.buildsByUpload[b.UploadID], b)
+}
+
+func (s *Store) indexBuildFile(bf *BuildFile) {
+	s.indexes.buildFilesByKey[bf.indexKey()] = bf
+}
+
+func (s *Store) unindexBuildFile(bf *BuildFile) {
+	if s.indexes.buildFilesByKey[bf.indexKey()] == bf {
+		delete(s.indexes.buildFilesByKey, bf.indexKey())
+	}
+}
+
+func (s *Store) indexGameAdmin(a *GameAdmin) {
+	s.indexes.gameAdminsByGame[a.GameID] = append(s.indexes.gameAdminsByGame[a.GameID], a)
+}
+
+func (s *Store) unindexGameAdmin(a *GameAdmin) {
+	s.indexes.gameAdminsByGame[a.GameID] = without(s.indexes.gameAdminsByGame[a.GameID], a)
+}
+
+func (bf *BuildFile) indexKey() buildFileKey {
+	return buildFileKey{
+		BuildID: bf.BuildID,
+		Type:    bf.Type,
+		SubType: bf.SubType,
+	}
+}
+
+// without returns list minus el, leaving list itself untouched
+// since callers may still be holding on to it.
+func without[T any](list []*T, el *T) []*T {
+	var res []*T
+	for _, other := range list {
+		if other != el {
+			res = append(res, other)
+		}
+	}
+	return res
+}
@@ -0,0 +1,248 @@
+package mitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+func (s *server) loginRoutes(route routeFunc) {
+	route("/login", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				user := r.store.findUserByUsername(r.Param("username"))
+				if user == nil || !user.CheckPassword(r.Param("password")) {
+					Throw(400, "Incorrect username or password")
+				}
+
+				if (user.RecaptchaNeeded || r.BoolParam("force_recaptcha")) && r.Param("recaptcha_response") == "" {
+					r.WriteJSON(Any{
+						"recaptcha_needed": true,
+						"recaptcha_url":    r.makeURL("/@recaptcha"),
+					})
+					return
+				}
+
+				if user.TOTPSecret != "" {
+					r.WriteJSON(Any{
+						"totp_needed": true,
+						"token":       r.store.makeTOTPToken(user),
+					})
+					return
+				}
+
+				r.WriteLoginSuccess(user)
+			},
+		})
+	})
+
+	route("/@recaptcha", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.Header().Set("content-type", "text/plain")
+				r.WriteHeader()
+				r.Write([]byte("mitch accepts any non-empty recaptcha_response\n"))
+			},
+		})
+	})
+
+	route("/totp/verify", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				// a wrong code doesn't use up the token, so users can retry
+				token := r.Param("token")
+				user := r.store.findTOTPTokenUser(token)
+				if user == nil {
+					Throw(400, "Invalid token")
+				}
+				if !user.CheckTOTPCode(r.Param("code"), time.Now()) {
+					Throw(400, "Invalid code")
+				}
+				r.store.takeTOTPToken(token)
+
+				r.WriteLoginSuccess(user)
+			},
+		})
+	})
+}
+
+// WriteLoginSuccess gives the user a fresh API key and a session cookie
+func (r *response) WriteLoginSuccess(user *User) {
+	apiKey := user.makeAPIKey(uuid.New().String())
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    user.makeSession(),
+		Path:     "/",
+		HttpOnly: true,
+	}
+	http.SetCookie(r.w, cookie)
+
+	r.WriteJSON(Any{
+		"key": FormatAPIKey(apiKey),
+		"cookie": Any{
+			cookie.Name: cookie.Value,
+		},
+	})
+}
+
+// RequireRecaptcha makes password logins ask for a captcha first
+func (u *User) RequireRecaptcha() {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.RecaptchaNeeded = true
+}
+
+const sessionCookieName = "itchio"
+
+// MakeSession logs the user in, returning the value of the
+// session cookie browsers would get.
+func (u *User) MakeSession() string {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeSession()
+}
+
+func (u *User) makeSession() string {
+	s := u.Store
+
+	session := uuid.New().String()
+	s.sessions[session] = u.ID
+	return session
+}
+
+// SessionUser returns the user logged in with the session
+// cookie, or nil if there is none.
+func (r *response) SessionUser() *User {
+	cookie, err := r.req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+
+	userID, ok := r.store.sessions[cookie.Value]
+	if !ok {
+		return nil
+	}
+	return r.store.findUser(userID)
+}
+
+func (u *User) SetPassword(password string) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.setPassword(password)
+}
+
+func (u *User) setPassword(password string) {
+	u.PasswordHash = hashPassword(password)
+}
+
+func (u *User) CheckPassword(password string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(u.PasswordHash), []byte(hashPassword(password))) == 1
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetTOTPSecret enables two-factor authentication for the user.
+// The secret is base32-encoded, like authenticator apps expect.
+func (u *User) SetTOTPSecret(secret string) {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	u.setTOTPSecret(secret)
+}
+
+func (u *User) setTOTPSecret(secret string) {
+	_, err := decodeTOTPSecret(secret)
+	must(err)
+	u.TOTPSecret = secret
+}
+
+// CheckTOTPCode accepts the codes for the previous, current
+// and next 30-second windows, to allow for clock drift.
+func (u *User) CheckTOTPCode(code string, t time.Time) bool {
+	for _, offset := range []time.Duration{-30 * time.Second, 0, 30 * time.Second} {
+		if TOTPCode(u.TOTPSecret, t.Add(offset)) == code {
+			return true
+		}
+	}
+	return false
+}
+
+// TOTPCode computes the RFC 6238 code (SHA-1, 6 digits, 30 second
+// windows) for a secret at a given time.
+func TOTPCode(secret string, t time.Time) string {
+	key, err := decodeTOTPSecret(secret)
+	must(err)
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(t.Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := (binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff) % 1000000
+	return fmt.Sprintf("%06d", code)
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(secret, "="))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding TOTP secret")
+	}
+	return key, nil
+}
+
+func (s *Store) MakeTOTPToken(u *User) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.makeTOTPToken(u)
+}
+
+func (s *Store) makeTOTPToken(u *User) string {
+	token := uuid.New().String()
+	s.totpTokens[token] = u.ID
+	return token
+}
+
+// TakeTOTPToken returns the user a TOTP token was issued for, if
+// any. Tokens can only be used once.
+func (s *Store) TakeTOTPToken(token string) *User {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.takeTOTPToken(token)
+}
+
+// findTOTPTokenUser is like takeTOTPToken, but leaves the token usable
+func (s *Store) findTOTPTokenUser(token string) *User {
+	userID, ok := s.totpTokens[token]
+	if !ok {
+		return nil
+	}
+	return s.findUser(userID)
+}
+
+func (s *Store) takeTOTPToken(token string) *User {
+	userID, ok := s.totpTokens[token]
+	if !ok {
+		return nil
+	}
+	delete(s.totpTokens, token)
+	return s.findUser(userID)
+}
@@ -0,0 +1,125 @@
+package mitch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TOTPCode(t *testing.T) {
+	assert := assert.New(t)
+
+	// test vectors from RFC 6238, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	assert.EqualValues("287082", TOTPCode(secret, time.Unix(59, 0)))
+	assert.EqualValues("081804", TOTPCode(secret, time.Unix(1111111109, 0)))
+	assert.EqualValues("050471", TOTPCode(secret, time.Unix(1111111111, 0)))
+}
+
+func Test_Login(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+
+	user := srv.Store().MakeUser("Login user")
+	user.SetPassword("hunter2")
+	user.SetTOTPSecret("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+
+	post := func(path string, form url.Values) (int, Any) {
+		res, err := http.PostForm(fmt.Sprintf("http://%s%s", srv.Address(), path), form)
+		assert.NoError(err)
+		defer res.Body.Close()
+		var payload Any
+		assert.NoError(json.NewDecoder(res.Body).Decode(&payload))
+		return res.StatusCode, payload
+	}
+
+	status, _ := post("/login", url.Values{"username": {user.Username}, "password": {"hunter3"}})
+	assert.EqualValues(400, status)
+
+	status, payload := post("/login", url.Values{"username": {user.Username}, "password": {"hunter2"}})
+	assert.EqualValues(200, status)
+	assert.EqualValues(true, payload["totp_needed"])
+	token := payload["token"].(string)
+
+	status, _ = post("/totp/verify", url.Values{"token": {"not-a-token"}, "code": {"000000"}})
+	assert.EqualValues(400, status)
+
+	// a wrong code can be retried with the same token
+	status, _ = post("/totp/verify", url.Values{"token": {token}, "code": {"000000"}})
+	assert.EqualValues(400, status)
+
+	code := TOTPCode(user.TOTPSecret, time.Now())
+	status, payload = post("/totp/verify", url.Values{"token": {token}, "code": {code}})
+	assert.EqualValues(200, status)
+	key := payload["key"].(map[string]interface{})["key"].(string)
+	assert.NotNil(srv.Store().FindAPIKeysByKey(key))
+	assert.NotEmpty(payload["cookie"].(map[string]interface{})["itchio"])
+
+	// tokens are single-use
+	status, _ = post("/totp/verify", url.Values{"token": {token}, "code": {code}})
+	assert.EqualValues(400, status)
+}
+
+func Test_LoginRecaptcha(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+
+	user := srv.Store().MakeUser("Suspicious user")
+	user.SetPassword("hunter2")
+	user.RequireRecaptcha()
+	other := srv.Store().MakeUser("Other user")
+	other.SetPassword("hunter2")
+
+	login := func(username string, extra url.Values) (int, Any) {
+		form := url.Values{"username": {username}, "password": {"hunter2"}}
+		for k, v := range extra {
+			form[k] = v
+		}
+		return apiRequest(t, srv, "POST", "/login", "", form)
+	}
+
+	status, payload := login(user.Username, nil)
+	assert.EqualValues(200, status)
+	assert.EqualValues(true, payload["recaptcha_needed"])
+	assert.Nil(payload["key"])
+	recaptchaURL := payload["recaptcha_url"].(string)
+
+	res, err := http.Get(recaptchaURL)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.EqualValues(200, res.StatusCode)
+
+	status, payload = login(user.Username, url.Values{"recaptcha_response": {"anything"}})
+	assert.EqualValues(200, status)
+	assert.Nil(payload["recaptcha_needed"])
+	assert.NotNil(payload["key"])
+
+	// a captcha response doesn't make up for a wrong password
+	status, _ = apiRequest(t, srv, "POST", "/login", "", url.Values{
+		"username":           {user.Username},
+		"password":           {"hunter3"},
+		"recaptcha_response": {"anything"},
+	})
+	assert.EqualValues(400, status)
+
+	status, payload = login(other.Username, nil)
+	assert.EqualValues(200, status)
+	assert.NotNil(payload["key"])
+	status, payload = login(other.Username, url.Values{"force_recaptcha": {"true"}})
+	assert.EqualValues(200, status)
+	assert.EqualValues(true, payload["recaptcha_needed"])
+}
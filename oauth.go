@@ -0,0 +1,218 @@
+package mitch
+
+import (
+	"crypto/subtle"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type oauthCode struct {
+	UserID      int64
+	AppID       int64
+	RedirectURI string
+	Scope       string
+	ExpiresAt   time.Time
+	// TokenExpiresAt is when the token it's exchanged for expires,
+	// so that it doesn't outlive the key that authorized it.
+	TokenExpiresAt time.Time
+}
+
+const oauthCodeTTL = 10 * time.Minute
+
+// defaultOAuthScope is granted when an app doesn't ask for any,
+// so that tokens never end up with full access.
+const defaultOAuthScope = "profile:me"
+
+func (s *server) oauthRoutes(route routeFunc, writeRoute routeFunc) {
+	// authorizing makes codes and tokens, even though it's a GET
+	writeRoute("/user/oauth", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				app := r.store.findOAuthAppByClientID(r.Param("client_id"))
+				if app == nil {
+					Throw(400, "invalid client_id")
+				}
+
+				redirectURI := r.Param("redirect_uri")
+				if redirectURI == "" {
+					redirectURI = app.RedirectURI
+				}
+				if redirectURI == "" || (app.RedirectURI != "" && redirectURI != app.RedirectURI) {
+					Throw(400, "invalid redirect_uri")
+				}
+				target, err := url.Parse(redirectURI)
+				if err != nil {
+					Throw(400, "invalid redirect_uri")
+				}
+
+				scope := r.Param("scope")
+				if strings.TrimSpace(scope) == "" {
+					scope = defaultOAuthScope
+				}
+
+				// authorizing with an api key can't grant more than the key
+				// itself: no wider scopes, and no outliving it.
+				var tokenExpiresAt time.Time
+				user := r.SessionUser()
+				if user == nil {
+					r.CheckAPIKey("profile:me")
+					for _, s := range strings.Fields(scope) {
+						r.AssertAuthorization(r.currentAPIKey.HasScope(s))
+					}
+					user = r.currentUser
+					tokenExpiresAt = r.currentAPIKey.ExpiresAt
+				}
+
+				params := url.Values{}
+				if state := r.Param("state"); state != "" {
+					params.Set("state", state)
+				}
+
+				responseType := r.Param("response_type")
+				switch {
+				case app.AutoDeny:
+					params.Set("error", "access_denied")
+				case responseType == "" || responseType == "code":
+					params.Set("code", r.store.makeOAuthCode(user, app, redirectURI, scope, tokenExpiresAt))
+				case responseType == "token":
+					// implicit grant: the token goes in the fragment, which
+					// is already encoded, so it mustn't be escaped again
+					token := user.makeOAuthAccessToken(scope)
+					token.ExpiresAt = tokenExpiresAt
+					params.Set("access_token", token.Key)
+					params.Set("token_type", "bearer")
+					params.Set("scope", scope)
+					r.RedirectTo(target.String() + "#" + params.Encode())
+					return
+				default:
+					params.Set("error", "unsupported_response_type")
+				}
+
+				query := target.Query()
+				for k, v := range params {
+					query[k] = v
+				}
+				target.RawQuery = query.Encode()
+				r.RedirectTo(target.String())
+			},
+		})
+	})
+
+	route("/user/oauth/token", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				if r.Param("grant_type") != "authorization_code" {
+					Throw(400, "unsupported_grant_type")
+				}
+
+				app := r.store.findOAuthAppByClientID(r.Param("client_id"))
+				if app == nil {
+					Throw(400, "invalid_client")
+				}
+				// mitch doesn't do PKCE, so every client must authenticate
+				secret := r.Param("client_secret")
+				if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(app.ClientSecret)) != 1 {
+					Throw(400, "invalid_client")
+				}
+
+				code := r.store.takeOAuthCode(r.Param("code"))
+				if code == nil || code.AppID != app.ID || time.Now().After(code.ExpiresAt) {
+					Throw(400, "invalid_grant")
+				}
+				if redirectURI := r.Param("redirect_uri"); redirectURI != "" && redirectURI != code.RedirectURI {
+					Throw(400, "invalid_grant")
+				}
+
+				user := r.FindUser(code.UserID)
+				token := user.makeOAuthAccessToken(code.Scope)
+				token.ExpiresAt = code.TokenExpiresAt
+				r.WriteJSON(Any{
+					"access_token": token.Key,
+					"token_type":   "bearer",
+					"scope":        code.Scope,
+				})
+			},
+		})
+	})
+}
+
+// MakeOAuthApp registers an app with a random client ID and secret
+func (u *User) MakeOAuthApp(name string, redirectURI string) *OAuthApp {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeOAuthApp(name, redirectURI)
+}
+
+func (u *User) makeOAuthApp(name string, redirectURI string) *OAuthApp {
+	s := u.Store
+
+	app := &OAuthApp{
+		Store:        s,
+		ID:           s.serial(),
+		UserID:       u.ID,
+		Name:         name,
+		ClientID:     uuid.New().String(),
+		ClientSecret: uuid.New().String(),
+		RedirectURI:  redirectURI,
+	}
+	s.OAuthApps[app.ID] = app
+	return app
+}
+
+// DenyAuthorizations makes the authorize endpoint redirect
+// with error=access_denied, as if the user had clicked "Deny".
+func (a *OAuthApp) DenyAuthorizations() {
+	a.Store.mutex.Lock()
+	defer a.Store.mutex.Unlock()
+	a.AutoDeny = true
+}
+
+// MakeOAuthAccessToken creates an API key with a random key, suitable
+// for use as an OAuth bearer token, limited to a space-separated
+// list of scopes, or to defaultOAuthScope if it's empty.
+func (u *User) MakeOAuthAccessToken(scope string) *APIKey {
+	u.Store.mutex.Lock()
+	defer u.Store.mutex.Unlock()
+	return u.makeOAuthAccessToken(scope)
+}
+
+func (u *User) makeOAuthAccessToken(scope string) *APIKey {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		scopes = []string{defaultOAuthScope}
+	}
+	return u.makeAPIKeyWithScopes(scopes, 0)
+}
+
+// MakeOAuthCode grants app access to u's account, for a token that
+// expires at tokenExpiresAt, or never if it's zero.
+func (s *Store) MakeOAuthCode(u *User, app *OAuthApp, redirectURI string, scope string, tokenExpiresAt time.Time) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.makeOAuthCode(u, app, redirectURI, scope, tokenExpiresAt)
+}
+
+func (s *Store) makeOAuthCode(u *User, app *OAuthApp, redirectURI string, scope string, tokenExpiresAt time.Time) string {
+	code := uuid.New().String()
+	s.oauthCodes[code] = &oauthCode{
+		UserID:      u.ID,
+		AppID:       app.ID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		ExpiresAt:   time.Now().Add(oauthCodeTTL),
+
+		TokenExpiresAt: tokenExpiresAt,
+	}
+	return code
+}
+
+// takeOAuthCode returns an authorization code's grant and
+// forgets it, since codes can only be exchanged once.
+func (s *Store) takeOAuthCode(code string) *oauthCode {
+	c := s.oauthCodes[code]
+	delete(s.oauthCodes, code)
+	return c
+}
@@ -0,0 +1,219 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OAuthCodeExchange(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx, WithAdminToken("admin-token"))
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("App developer")
+	status, payload := adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/oauth-apps", dev.ID), url.Values{
+		"name":          {"Some App"},
+		"redirect_uri":  {"http://localhost:8080/callback"},
+		"client_id":     {"some-app"},
+		"client_secret": {"some-secret"},
+	})
+	assert.EqualValues(200, status)
+	assert.EqualValues("some-app", payload["oauth_app"].(map[string]interface{})["client_id"])
+	status, _ = adminRequest(t, srv, "POST", fmt.Sprintf("/@admin/users/%d/oauth-apps", dev.ID), url.Values{
+		"name":      {"Impostor"},
+		"client_id": {"some-app"},
+	})
+	assert.EqualValues(400, status)
+
+	user := store.MakeUser("Some user")
+	sessionKey := user.MakeAPIKey().Key
+
+	authorize := func(scope string) string {
+		form := url.Values{
+			"client_id":    {"some-app"},
+			"redirect_uri": {"http://localhost:8080/callback"},
+			"scope":        {scope},
+			"state":        {"xyz"},
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/user/oauth?%s", srv.Address(), form.Encode()), nil)
+		assert.NoError(err)
+		req.Header.Set("Authorization", sessionKey)
+		res, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.EqualValues(302, res.StatusCode)
+
+		location, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		assert.True(strings.HasPrefix(location.String(), "http://localhost:8080/callback?"))
+		assert.EqualValues("xyz", location.Query().Get("state"))
+		return location.Query().Get("code")
+	}
+
+	exchange := func(code string, clientSecret string) (int, Any) {
+		form := url.Values{
+			"grant_type":   {"authorization_code"},
+			"client_id":    {"some-app"},
+			"code":         {code},
+			"redirect_uri": {"http://localhost:8080/callback"},
+		}
+		if clientSecret != "" {
+			form.Set("client_secret", clientSecret)
+		}
+		return apiRequest(t, srv, "POST", "/user/oauth/token", "", form)
+	}
+
+	code := authorize("profile:me")
+	assert.NotEmpty(code)
+
+	status, payload = exchange(code, "")
+	assert.EqualValues(400, status, "client_secret is required")
+	status, payload = exchange(code, "wrong-secret")
+	assert.EqualValues(400, status)
+
+	status, payload = exchange(code, "some-secret")
+	assert.EqualValues(200, status)
+	assert.EqualValues("bearer", payload["token_type"])
+	assert.EqualValues("profile:me", payload["scope"])
+	accessToken := payload["access_token"].(string)
+
+	status, payload = apiRequest(t, srv, "GET", "/profile", "Bearer "+accessToken, nil)
+	assert.EqualValues(200, status)
+	assert.EqualValues(user.ID, payload["user"].(map[string]interface{})["id"])
+	status, _ = apiRequest(t, srv, "GET", "/profile/owned-keys", "Bearer "+accessToken, nil)
+	assert.EqualValues(403, status, "token is limited to the granted scope")
+
+	status, _ = exchange(code, "some-secret")
+	assert.EqualValues(400, status, "codes can only be exchanged once")
+
+	status, _ = apiRequest(t, srv, "POST", "/user/oauth/token", "", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"some-app"},
+		"client_secret": {"some-secret"},
+		"code":          {authorize("profile:me")},
+		"redirect_uri":  {"http://evil.example.org/callback"},
+	})
+	assert.EqualValues(400, status)
+
+	// asking for no scope at all doesn't grant full access
+	status, payload = exchange(authorize(""), "some-secret")
+	assert.EqualValues(200, status)
+	assert.EqualValues(defaultOAuthScope, payload["scope"])
+	accessToken = payload["access_token"].(string)
+	assert.EqualValues([]string{defaultOAuthScope}, store.FindAPIKeysByKey(accessToken).Scopes)
+	status, _ = apiRequest(t, srv, "GET", "/profile/owned-keys", "Bearer "+accessToken, nil)
+	assert.EqualValues(403, status)
+	assert.EqualValues([]string{defaultOAuthScope}, user.MakeOAuthAccessToken(" ").Scopes)
+}
+
+func Test_OAuthAuthorize(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("App developer")
+	app := dev.MakeOAuthApp("Some App", "http://localhost:8080/callback")
+	user := store.MakeUser("Some user")
+
+	// authorize doesn't follow the redirect, so the callback
+	// doesn't need to exist.
+	authorize := func(setAuth func(req *http.Request), form url.Values) *http.Response {
+		form.Set("client_id", app.ClientID)
+		form.Set("state", "xyz")
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/user/oauth?%s", srv.Address(), form.Encode()), nil)
+		assert.NoError(err)
+		setAuth(req)
+		res, err := http.DefaultTransport.RoundTrip(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+	withKey := func(key string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", key) }
+	}
+	withSession := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "itchio", Value: user.MakeSession()})
+	}
+	location := func(res *http.Response) *url.URL {
+		assert.EqualValues(302, res.StatusCode)
+		location, err := url.Parse(res.Header.Get("Location"))
+		assert.NoError(err)
+		return location
+	}
+
+	res := authorize(func(req *http.Request) {}, url.Values{})
+	assert.EqualValues(401, res.StatusCode, "someone has to be logged in")
+
+	// implicit grant, with the session cookie
+	target := location(authorize(withSession, url.Values{
+		"response_type": {"token"},
+		"scope":         {"profile:me profile:owned"},
+	}))
+	assert.Empty(target.RawQuery)
+	fragment, err := url.ParseQuery(target.EscapedFragment())
+	assert.NoError(err)
+	assert.EqualValues("xyz", fragment.Get("state"))
+	assert.EqualValues("bearer", fragment.Get("token_type"))
+	assert.EqualValues("profile:me profile:owned", fragment.Get("scope"))
+	token := store.FindAPIKeysByKey(fragment.Get("access_token"))
+	if assert.NotNil(token) {
+		assert.EqualValues(user.ID, token.UserID)
+		assert.EqualValues([]string{"profile:me", "profile:owned"}, token.Scopes)
+		assert.True(token.ExpiresAt.IsZero())
+	}
+
+	// an api key can't grant more than it has
+	limitedKey := user.MakeAPIKeyWithScopes([]string{"profile:me"}, time.Hour)
+	res = authorize(withKey(limitedKey.Key), url.Values{
+		"response_type": {"token"},
+		"scope":         {"profile:me profile:owned"},
+	})
+	assert.EqualValues(403, res.StatusCode)
+	res = authorize(withKey(limitedKey.Key), url.Values{"scope": {"profile:owned"}})
+	assert.EqualValues(403, res.StatusCode)
+
+	// ...and the tokens it grants don't outlive it
+	target = location(authorize(withKey(limitedKey.Key), url.Values{"response_type": {"token"}}))
+	fragment, err = url.ParseQuery(target.EscapedFragment())
+	assert.NoError(err)
+	assert.EqualValues(limitedKey.ExpiresAt, store.FindAPIKeysByKey(fragment.Get("access_token")).ExpiresAt)
+
+	target = location(authorize(withKey(limitedKey.Key), url.Values{"scope": {"profile:me"}}))
+	status, payload := apiRequest(t, srv, "POST", "/user/oauth/token", "", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {app.ClientID},
+		"client_secret": {app.ClientSecret},
+		"code":          {target.Query().Get("code")},
+	})
+	assert.EqualValues(200, status)
+	assert.EqualValues(limitedKey.ExpiresAt, store.FindAPIKeysByKey(payload["access_token"].(string)).ExpiresAt)
+
+	res = authorize(withSession, url.Values{"response_type": {"id_token"}})
+	assert.EqualValues("unsupported_response_type", location(res).Query().Get("error"))
+
+	app.DenyAuthorizations()
+	keyCount := len(store.APIKeys)
+	for _, responseType := range []string{"code", "token"} {
+		target = location(authorize(withSession, url.Values{"response_type": {responseType}}))
+		assert.True(strings.HasPrefix(target.String(), "http://localhost:8080/callback?"))
+		assert.EqualValues("access_denied", target.Query().Get("error"))
+		assert.EqualValues("xyz", target.Query().Get("state"))
+		assert.Empty(target.Query().Get("code"))
+	}
+	assert.Len(store.APIKeys, keyCount, "denied authorizations don't make tokens")
+}
@@ -1,41 +1,363 @@
 package mitch
 
+import (
+	"strings"
+	"time"
+)
+
+// Every query has an exported version, which read-locks the store,
+// and an unexported one for callers that already hold the lock.
+
 func (s *Store) FindAPIKeysByKey(key string) *APIKey {
-	return s.SelectAPIKey(NoSort(), Eq{"Key": key})
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findAPIKeyByKey(key)
+}
+
+func (s *Store) findAPIKeyByKey(key string) *APIKey {
+	return s.indexes.apiKeysByKey[key]
+}
+
+func (s *Store) FindAPIKey(id int64) *APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findAPIKey(id)
+}
+
+func (s *Store) findAPIKey(id int64) *APIKey {
+	return s.APIKeys[id]
 }
 
 func (s *Store) ListAPIKeysByUser(userID int64) []*APIKey {
-	return s.SelectAPIKeys(NoSort(), Eq{"UserID": userID})
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listAPIKeysByUser(userID)
+}
+
+func (s *Store) listAPIKeysByUser(userID int64) []*APIKey {
+	return from(s.APIKeys).
+		Where(func(k *APIKey) bool { return k.UserID == userID }).
+		OrderBy(Asc(func(k *APIKey) int64 { return k.ID })).
+		All()
 }
 
 func (s *Store) FindUser(id int64) *User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findUser(id)
+}
+
+func (s *Store) findUser(id int64) *User {
 	return s.Users[id]
 }
 
+func (s *Store) FindUserByUsername(username string) *User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findUserByUsername(username)
+}
+
+func (s *Store) findUserByUsername(username string) *User {
+	return from(s.Users).Where(func(u *User) bool { return u.Username == username }).First()
+}
+
 func (s *Store) FindUserGameSession(id int64) *UserGameSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findUserGameSession(id)
+}
+
+func (s *Store) findUserGameSession(id int64) *UserGameSession {
 	return s.UserGameSessions[id]
 }
 
 func (s *Store) FindGame(id int64) *Game {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findGame(id)
+}
+
+func (s *Store) findGame(id int64) *Game {
 	return s.Games[id]
 }
 
 func (s *Store) FindUpload(id int64) *Upload {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findUpload(id)
+}
+
+func (s *Store) findUpload(id int64) *Upload {
 	return s.Uploads[id]
 }
 
 func (s *Store) FindBuild(id int64) *Build {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findBuild(id)
+}
+
+func (s *Store) findBuild(id int64) *Build {
 	return s.Builds[id]
 }
 
+func (s *Store) FindDownloadKey(id int64) *DownloadKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findDownloadKey(id)
+}
+
+func (s *Store) findDownloadKey(id int64) *DownloadKey {
+	return s.DownloadKeys[id]
+}
+
+func (s *Store) FindCollection(id int64) *Collection {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findCollection(id)
+}
+
+func (s *Store) findCollection(id int64) *Collection {
+	return s.Collections[id]
+}
+
+func (s *Store) FindOAuthAppByClientID(clientID string) *OAuthApp {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findOAuthAppByClientID(clientID)
+}
+
+func (s *Store) findOAuthAppByClientID(clientID string) *OAuthApp {
+	return from(s.OAuthApps).Where(func(a *OAuthApp) bool { return a.ClientID == clientID }).First()
+}
+
+func (s *Store) FindBuildFile(id int64) *BuildFile {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findBuildFile(id)
+}
+
+func (s *Store) findBuildFile(id int64) *BuildFile {
+	return s.BuildFiles[id]
+}
+
+// findPendingBuildFileByCDNPath finds the build file that was handed
+// out for upload at path and hasn't been uploaded yet.
+func (s *Store) findPendingBuildFileByCDNPath(path string) *BuildFile {
+	return from(s.BuildFiles).Where(func(bf *BuildFile) bool { return bf.Status == "created" && bf.CDNPath() == path }).First()
+}
+
+func (s *Store) findUploadSessionByPath(path string) *UploadSession {
+	return from(s.UploadSessions).Where(func(us *UploadSession) bool { return us.Path == path }).First()
+}
+
+func (s *Store) FindCDNFile(path string) *CDNFile {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findCDNFile(path)
+}
+
+func (s *Store) findCDNFile(path string) *CDNFile {
+	return s.CDNFiles[path]
+}
+
+// FindGameByTarget looks up a game from a wharf target like "username/game-slug"
+func (s *Store) FindGameByTarget(target string) *Game {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findGameByTarget(target)
+}
+
+func (s *Store) findGameByTarget(target string) *Game {
+	tokens := strings.SplitN(target, "/", 2)
+	if len(tokens) != 2 {
+		return nil
+	}
+
+	user := s.findUserByUsername(tokens[0])
+	if user == nil {
+		return nil
+	}
+
+	return from(s.Games).
+		Where(func(g *Game) bool { return g.UserID == user.ID && s.slugify(g.Title) == tokens[1] }).
+		OrderBy(Asc(func(g *Game) int64 { return g.ID })).
+		First()
+}
+
+func (s *Store) FindUploadByChannel(gameID int64, channelName string) *Upload {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findUploadByChannel(gameID, channelName)
+}
+
+func (s *Store) findUploadByChannel(gameID int64, channelName string) *Upload {
+	return fromSlice(s.indexes.uploadsByGame[gameID]).
+		Where(func(u *Upload) bool { return u.ChannelName == channelName }).
+		OrderBy(Asc(func(u *Upload) int64 { return u.ID })).
+		First()
+}
+
+// ListGamesByEditor returns games the user owns or administers
+func (s *Store) ListGamesByEditor(user *User) []*Game {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listGamesByEditor(user)
+}
+
+func (s *Store) listGamesByEditor(user *User) []*Game {
+	return from(s.Games).
+		Where(func(g *Game) bool { return g.CanBeEditedBy(user) }).
+		OrderBy(Asc(func(g *Game) int64 { return g.ID })).
+		All()
+}
+
+func (s *Sale) IsActive(now time.Time) bool {
+	return !now.Before(s.StartDate) && now.Before(s.EndDate)
+}
+
+// FindActiveSaleByGame returns the game's ongoing sale, if any
+func (s *Store) FindActiveSaleByGame(gameID int64) *Sale {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.findActiveSaleByGame(gameID)
+}
+
+func (s *Store) findActiveSaleByGame(gameID int64) *Sale {
+	now := time.Now().UTC()
+	return from(s.Sales).
+		Where(func(sale *Sale) bool { return sale.GameID == gameID && sale.IsActive(now) }).
+		OrderBy(Desc(func(sale *Sale) int64 { return sale.ID })).
+		First()
+}
+
 func (s *Store) ListUploadsByGame(gameID int64) []*Upload {
-	return s.SelectUploads(NoSort(), Eq{"GameID": gameID})
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listUploadsByGame(gameID)
+}
+
+func (s *Store) listUploadsByGame(gameID int64) []*Upload {
+	return fromSlice(s.indexes.uploadsByGame[gameID]).All()
 }
 
 func (s *Store) ListBuildsByUpload(uploadID int64) []*Build {
-	return s.SelectBuilds(SortBy("ID", "desc"), Eq{"UploadID": uploadID})
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listBuildsByUpload(uploadID)
+}
+
+func (s *Store) listBuildsByUpload(uploadID int64) []*Build {
+	return fromSlice(s.indexes.buildsByUpload[uploadID]).
+		OrderBy(Desc(func(b *Build) int64 { return b.ID })).
+		All()
 }
 
 func (s *Store) ListGameAdminsByGame(gameID int64) []*GameAdmin {
-	return s.SelectGameAdmins(NoSort(), Eq{"GameID": gameID})
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listGameAdminsByGame(gameID)
+}
+
+func (s *Store) listGameAdminsByGame(gameID int64) []*GameAdmin {
+	return fromSlice(s.indexes.gameAdminsByGame[gameID]).All()
+}
+
+func (s *Store) ListBuildFilesByBuild(buildID int64) []*BuildFile {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listBuildFilesByBuild(buildID)
+}
+
+func (s *Store) listBuildFilesByBuild(buildID int64) []*BuildFile {
+	return from(s.BuildFiles).
+		Where(func(bf *BuildFile) bool { return bf.BuildID == buildID }).
+		OrderBy(Asc(func(bf *BuildFile) int64 { return bf.ID })).
+		All()
+}
+
+func (s *Store) ListDownloadKeysByOwner(userID int64) []*DownloadKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listDownloadKeysByOwner(userID)
+}
+
+func (s *Store) listDownloadKeysByOwner(userID int64) []*DownloadKey {
+	return from(s.DownloadKeys).
+		Where(func(dk *DownloadKey) bool { return dk.OwnerID == userID }).
+		OrderBy(Desc(func(dk *DownloadKey) int64 { return dk.ID })).
+		All()
+}
+
+func (s *Store) ListUserGameSessions(userID int64, gameID int64) []*UserGameSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listUserGameSessions(userID, gameID)
+}
+
+func (s *Store) listUserGameSessions(userID int64, gameID int64) []*UserGameSession {
+	return from(s.UserGameSessions).
+		Where(func(ugs *UserGameSession) bool { return ugs.UserID == userID && ugs.GameID == gameID }).
+		OrderBy(Asc(func(ugs *UserGameSession) int64 { return ugs.ID })).
+		All()
+}
+
+func (s *Store) ListCollectionsByUser(userID int64) []*Collection {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listCollectionsByUser(userID)
+}
+
+func (s *Store) listCollectionsByUser(userID int64) []*Collection {
+	return from(s.Collections).
+		Where(func(c *Collection) bool { return c.UserID == userID }).
+		OrderBy(Asc(func(c *Collection) int64 { return c.ID })).
+		All()
+}
+
+func (s *Store) ListCollectionGamesByCollection(collectionID int64) []*CollectionGame {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.listCollectionGamesByCollection(collectionID)
+}
+
+func (s *Store) listCollectionGamesByCollection(collectionID int64) []*CollectionGame {
+	return from(s.CollectionGames).
+		Where(func(cg *CollectionGame) bool { return cg.CollectionID == collectionID }).
+		OrderBy(Asc(func(cg *CollectionGame) int64 { return cg.Position })).
+		All()
+}
+
+// SearchGames returns games whose title contains query, ignoring case
+func (s *Store) SearchGames(query string) []*Game {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.searchGames(query)
+}
+
+func (s *Store) searchGames(query string) []*Game {
+	query = strings.ToLower(query)
+	return from(s.Games).
+		Where(func(g *Game) bool { return strings.Contains(strings.ToLower(g.Title), query) }).
+		OrderBy(Asc(func(g *Game) int64 { return g.ID })).
+		All()
+}
+
+// SearchUsers returns users whose username or display name
+// contains query, ignoring case
+func (s *Store) SearchUsers(query string) []*User {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.searchUsers(query)
+}
+
+func (s *Store) searchUsers(query string) []*User {
+	query = strings.ToLower(query)
+	return from(s.Users).
+		Where(func(u *User) bool {
+			return strings.Contains(strings.ToLower(u.Username), query) ||
+				strings.Contains(strings.ToLower(u.DisplayName), query)
+		}).
+		OrderBy(Asc(func(u *User) int64 { return u.ID })).
+		All()
 }
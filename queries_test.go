@@ -3,6 +3,7 @@ package mitch
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,35 +19,401 @@ func Test_Select(t *testing.T) {
 			user = u
 		}
 		for j := 0; j < 4; j++ {
-			u.MakeGame(fmt.Sprintf("game %d-%d", i, j))
+			g := u.MakeGame(fmt.Sprintf("game %d-%d", i, j))
+			g.SetStats(int64(j%2), 0, 0)
 		}
 	}
 
-	var games []*Game
-	s.Select(&games, SortBy("ID", "asc").ForMap(s.Games), Eq{"UserID": user.ID})
-	assert.EqualValues(4, len(games))
-	for _, g := range games {
+	gameID := func(g *Game) int64 { return g.ID }
+	gameUserID := func(g *Game) int64 { return g.UserID }
+	gameViews := func(g *Game) int64 { return g.ViewsCount }
+	gameTitle := func(g *Game) string { return g.Title }
+
+	games := Select(s, s.Games).
+		Where(Eq(gameUserID, user.ID)).
+		OrderBy(Asc(gameID)).
+		All()
+	assert.Len(games, 4)
+	for i, g := range games {
 		assert.EqualValues(user.ID, g.UserID)
+		if i > 0 {
+			assert.True(games[i-1].ID < g.ID)
+		}
 	}
 
-	lastGameID := int64(-1)
-	for _, g := range games {
-		assert.True(lastGameID < g.ID)
-		lastGameID = g.ID
+	// sorts compose instead of overriding each other
+	games = Select(s, s.Games).
+		Where(Eq(gameUserID, user.ID)).
+		OrderBy(Desc(gameViews), Asc(gameID)).
+		All()
+	assert.EqualValues([]string{"game 0-1", "game 0-3", "game 0-0", "game 0-2"},
+		[]string{games[0].Title, games[1].Title, games[2].Title, games[3].Title})
+
+	games = Select(s, s.Games).
+		Where(In(gameTitle, "game 1-2", "game 3-0", "nope")).
+		OrderBy(Asc(gameTitle)).
+		All()
+	assert.Len(games, 2)
+	assert.EqualValues("game 1-2", games[0].Title)
+	assert.EqualValues("game 3-0", games[1].Title)
+
+	assert.EqualValues(4, Select(s, s.Games).Where(Like(gameTitle, "GAME 2-%")).Count())
+	assert.EqualValues(4, Select(s, s.Games).Where(Like(gameTitle, "%-_")).Where(Like(gameTitle, "%3")).Count())
+	assert.EqualValues(0, Select(s, s.Games).Where(Like(gameTitle, "game.%")).Count())
+
+	all := Select(s, s.Games).OrderBy(Asc(gameID)).All()
+	assert.Len(all, 16)
+	assert.EqualValues(8, Select(s, s.Games).Where(Gt(gameID, all[7].ID)).Count())
+	assert.EqualValues(3, Select(s, s.Games).Where(Lt(gameID, all[3].ID)).Count())
+
+	largest := Select(s, s.Games).OrderBy(Desc(gameID)).First()
+	assert.EqualValues(all[15].ID, largest.ID)
+
+	games = Select(s, s.Games).OrderBy(Asc(gameID)).Offset(14).Limit(5).All()
+	assert.Len(games, 2)
+	assert.EqualValues(largest.ID, games[1].ID)
+	assert.Empty(Select(s, s.Games).Offset(16).All())
+
+	assert.Nil(Select(s, s.Games).Where(Eq(gameUserID, -1)).First())
+
+	// results point into the store
+	game := Select(s, s.Games).Where(Eq(gameID, largest.ID)).First()
+	game.Title = "renamed"
+	assert.EqualValues("renamed", s.FindGame(largest.ID).Title)
+}
+
+func Test_SearchGames(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Searcher")
+	a := user.MakeGame("Space Quest")
+	user.MakeGame("Dungeon crawler")
+	b := user.MakeGame("Another SPACE game")
+
+	games := s.SearchGames("space")
+	assert.EqualValues(2, len(games))
+	assert.EqualValues(a.ID, games[0].ID)
+	assert.EqualValues(b.ID, games[1].ID)
+
+	assert.EqualValues(3, len(s.SearchGames("")))
+	assert.EqualValues(0, len(s.SearchGames("racing")))
+}
+
+func Test_CollectionGames(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Collector")
+	c := user.MakeCollection("Favorites")
+	a := user.MakeGame("A")
+	b := user.MakeGame("B")
+	c.AddGame(b)
+	c.AddGame(a)
+
+	cgs := s.ListCollectionGamesByCollection(c.ID)
+	assert.EqualValues(2, len(cgs))
+	assert.EqualValues(b.ID, cgs[0].GameID)
+	assert.EqualValues(1, cgs[0].Position)
+	assert.EqualValues(a.ID, cgs[1].GameID)
+	assert.EqualValues(2, cgs[1].Position)
+
+	assert.EqualValues(1, len(s.ListCollectionsByUser(user.ID)))
+}
+
+func Test_ListGamesByEditor(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	owner := s.MakeUser("Owner")
+	admin := s.MakeUser("Admin")
+	a := owner.MakeGame("A")
+	b := owner.MakeGame("B")
+	b.AddAdmin(admin)
+	c := admin.MakeGame("C")
+
+	games := s.ListGamesByEditor(owner)
+	assert.EqualValues(2, len(games))
+	assert.EqualValues(a.ID, games[0].ID)
+	assert.EqualValues(b.ID, games[1].ID)
+
+	games = s.ListGamesByEditor(admin)
+	assert.EqualValues(2, len(games))
+	assert.EqualValues(b.ID, games[0].ID)
+	assert.EqualValues(c.ID, games[1].ID)
+}
+
+func Test_Sales(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	dev := s.MakeUser("Dev")
+	game := dev.MakeGame("Discounted")
+	assert.Nil(s.FindActiveSaleByGame(game.ID))
+
+	sale := game.StartSale(30, time.Hour)
+	active := s.FindActiveSaleByGame(game.ID)
+	assert.NotNil(active)
+	assert.EqualValues(sale.ID, active.ID)
+	assert.EqualValues(30, FormatGame(game)["sale"].(Any)["rate"])
+	assert.EqualValues(dev.ID, FormatGame(game)["user"].(Any)["id"])
+
+	game.EndSale()
+	assert.Nil(s.FindActiveSaleByGame(game.ID))
+	assert.Nil(FormatGame(game)["sale"])
+}
+
+func Test_UserGameSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Player")
+	game := user.MakeGame("Played")
+	other := user.MakeGame("Other")
+
+	first := user.MakeGameSession(game)
+	first.Update(60, false, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	second := user.MakeGameSession(game)
+	second.Update(30, true, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC))
+	user.MakeGameSession(other).Update(1000, false, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC))
+
+	summary := FormatUserGameSummary(s.ListUserGameSessions(user.ID, game.ID))
+	assert.EqualValues(90, summary["seconds_run"])
+	assert.EqualValues(second.LastRunAt, summary["last_run_at"])
+}
+
+func Test_Indexes(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Indexed")
+	apiKey := user.MakeAPIKey()
+	assert.EqualValues(apiKey.ID, s.FindAPIKeysByKey(apiKey.Key).ID)
+
+	oldKey := apiKey.Key
+	apiKey.SetKey("renamed-key")
+	assert.Nil(s.FindAPIKeysByKey(oldKey))
+	assert.EqualValues(apiKey.ID, s.FindAPIKeysByKey("renamed-key").ID)
+
+	assert.True(s.RevokeAPIKey("renamed-key"))
+	assert.Nil(s.FindAPIKeysByKey("renamed-key"))
+
+	game := user.MakeGame("Indexed game")
+	admin := game.AddAdmin(s.MakeUser("Admin"))
+	assert.Len(s.ListGameAdminsByGame(game.ID), 1)
+	assert.True(s.DeleteGameAdmin(admin.ID))
+	assert.Empty(s.ListGameAdminsByGame(game.ID))
+
+	first := game.MakeUpload("First")
+	second := game.MakeUpload("Second")
+	uploads := s.ListUploadsByGame(game.ID)
+	assert.Len(uploads, 2)
+	assert.EqualValues(first.ID, uploads[0].ID)
+	assert.EqualValues(second.ID, uploads[1].ID)
+
+	b1 := first.MakeBuild()
+	b2 := first.MakeBuild()
+	builds := s.ListBuildsByUpload(first.ID)
+	assert.Len(builds, 2)
+	assert.EqualValues(b2.ID, builds[0].ID)
+	assert.EqualValues(b1.ID, builds[1].ID)
+
+	bf := b2.MakeFile("patch", "optimized")
+	assert.EqualValues(bf.ID, b2.GetFile("patch", "optimized").ID)
+	assert.Nil(b2.GetFile("patch", "default"))
+	assert.Nil(b1.GetFile("patch", "optimized"))
+}
+
+// benchmarkWorld makes a store the size of the bigger fixtures,
+// and returns one of its users.
+func benchmarkWorld(b *testing.B) (*Store, *User) {
+	s := newStore()
+	var user *User
+	for i := 0; i < 2000; i++ {
+		user = s.MakeUser(fmt.Sprintf("user %d", i))
+		user.MakeAPIKey()
+		game := user.MakeGame(fmt.Sprintf("game %d", i))
+		game.AddAdmin(user)
+		upload := game.MakeUpload("All platforms")
+		for j := 0; j < 3; j++ {
+			build := upload.MakeBuild()
+			build.MakeFile("archive", "default")
+			build.MakeFile("signature", "default")
+		}
 	}
+	b.ResetTimer()
+	return s, user
+}
+
+// The scan variants do what the queries did before indexes.
+
+func Benchmark_FindAPIKeysByKey(b *testing.B) {
+	s, user := benchmarkWorld(b)
+	key := s.ListAPIKeysByUser(user.ID)[0].Key
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.FindAPIKeysByKey(key)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Select(s, s.APIKeys).Where(func(k *APIKey) bool { return k.Key == key }).First()
+		}
+	})
+}
+
+func Benchmark_ListUploadsByGame(b *testing.B) {
+	s, user := benchmarkWorld(b)
+	gameID := s.ListGamesByEditor(user)[0].ID
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.ListUploadsByGame(gameID)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Select(s, s.Uploads).Where(func(u *Upload) bool { return u.GameID == gameID }).All()
+		}
+	})
+}
+
+func Benchmark_ListBuildsByUpload(b *testing.B) {
+	s, user := benchmarkWorld(b)
+	uploadID := s.ListUploadsByGame(s.ListGamesByEditor(user)[0].ID)[0].ID
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.ListBuildsByUpload(uploadID)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Select(s, s.Builds).
+				Where(func(b *Build) bool { return b.UploadID == uploadID }).
+				OrderBy(Desc(func(b *Build) int64 { return b.ID })).
+				All()
+		}
+	})
+}
+
+func Benchmark_GetFile(b *testing.B) {
+	s, user := benchmarkWorld(b)
+	upload := s.ListUploadsByGame(s.ListGamesByEditor(user)[0].ID)[0]
+	build := s.ListBuildsByUpload(upload.ID)[0]
 
-	largestID := int64(0)
-	for _, g := range games {
-		if g.ID > largestID {
-			largestID = g.ID
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			build.GetFile("signature", "default")
 		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Select(s, s.BuildFiles).Where(func(bf *BuildFile) bool {
+				return bf.BuildID == build.ID && bf.Type == "signature" && bf.SubType == "default"
+			}).First()
+		}
+	})
+}
+
+func Benchmark_ListGameAdminsByGame(b *testing.B) {
+	s, user := benchmarkWorld(b)
+	gameID := s.ListGamesByEditor(user)[0].ID
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.ListGameAdminsByGame(gameID)
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Select(s, s.GameAdmins).Where(func(a *GameAdmin) bool { return a.GameID == gameID }).All()
+		}
+	})
+}
+
+func Test_DeleteGame(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	dev := s.MakeUser("Developer")
+	player := s.MakeUser("Player")
+	game := dev.MakeGame("Doomed")
+	game.Publish()
+	game.AddAdmin(player)
+	game.StartSale(50, time.Hour)
+	dk := player.BuyGame(game)
+	session := player.MakeGameSession(game)
+	collection := player.MakeCollection("Faves")
+	collection.AddGame(game)
+
+	hosted := game.MakeUpload("Hosted")
+	hosted.SetZipContents()
+	pushed := game.MakeUpload("Pushed")
+	pushed.SetAllPlatforms()
+	first := pushed.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("hello.txt").String("v1")
+	})
+	second := pushed.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("hello.txt").String("v2")
+	})
+	assert.EqualValues(second.ID, pushed.Head)
+	assert.NotEmpty(s.CDNFiles)
+	firstArchive := first.GetFile("archive", "default")
+	assert.EqualValues(second.GetFile("archive", "default").Size, pushed.Size)
+	assert.NotEqual(firstArchive.Filename, pushed.Filename)
+	updatedAt := pushed.UpdatedAt
+
+	// deleting the head build falls back to the previous one
+	files := s.ListBuildFilesByBuild(second.ID)
+	assert.NotEmpty(files)
+	assert.True(s.DeleteBuild(second.ID))
+	assert.False(s.DeleteBuild(second.ID))
+	assert.EqualValues(first.ID, pushed.Head)
+	assert.EqualValues("build", pushed.Storage)
+	assert.EqualValues(firstArchive.Filename, pushed.Filename)
+	assert.EqualValues(firstArchive.Size, pushed.Size)
+	assert.True(pushed.UpdatedAt.After(updatedAt))
+	assert.Nil(s.FindBuild(second.ID))
+	for _, bf := range files {
+		assert.Nil(s.FindBuildFile(bf.ID))
+		assert.Nil(s.FindCDNFile(bf.CDNPath()))
 	}
+	assert.Nil(second.GetFile("archive", "default"))
+	assert.Len(s.ListBuildsByUpload(pushed.ID), 1)
+
+	// and deleting the last one leaves the upload empty
+	third := pushed.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("hello.txt").String("v3")
+	})
+	assert.True(s.DeleteBuild(third.ID))
+	assert.True(s.DeleteBuild(first.ID))
+	assert.EqualValues(0, pushed.Head)
+	assert.Empty(pushed.Storage)
+	assert.Empty(pushed.Filename)
+	assert.EqualValues(0, pushed.Size)
+	assert.Nil(pushed.CDNFile())
+	first = pushed.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("hello.txt").String("v4")
+	})
 
-	var game Game
-	success := s.SelectOne(&game, SortBy("ID", "desc").ForMap(s.Games), Eq{"UserID": user.ID})
-	assert.True(success)
-	assert.EqualValues(game.ID, largestID)
+	assert.True(s.DeleteGame(game.ID))
+	assert.False(s.DeleteGame(game.ID))
+	assert.Nil(s.FindGame(game.ID))
+	assert.Nil(s.FindUpload(hosted.ID))
+	assert.Nil(s.FindUpload(pushed.ID))
+	assert.Nil(s.FindBuild(first.ID))
+	assert.Empty(s.ListUploadsByGame(game.ID))
+	assert.Empty(s.ListGameAdminsByGame(game.ID))
+	assert.Nil(s.FindDownloadKey(dk.ID))
+	assert.Nil(s.FindUserGameSession(session.ID))
+	assert.Nil(s.FindActiveSaleByGame(game.ID))
+	assert.Empty(s.ListCollectionGamesByCollection(collection.ID))
+	assert.Empty(s.CDNFiles)
+	assert.Empty(s.GameAdmins)
 
-	success = s.SelectOne(&game, NoSort().ForMap(s.Games), Eq{"UserID": -1})
-	assert.False(success)
+	// the rest is untouched
+	assert.NotNil(s.FindUser(dev.ID))
+	assert.NotNil(s.FindCollection(collection.ID))
 }
@@ -0,0 +1,214 @@
+package mitch
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Query is a typed query over one of the store's tables. Results
+// are pointers into the store, so callers see (and make) changes to
+// the actual objects.
+//
+//	games := Select(s, s.Games).
+//		Where(func(g *Game) bool { return g.Published }).
+//		OrderBy(Desc(func(g *Game) int64 { return g.ViewsCount }),
+//			Asc(func(g *Game) int64 { return g.ID })).
+//		Limit(10).
+//		All()
+type Query[T any] struct {
+	// read-locked while the query runs, if set
+	store *Store
+
+	each   func(yield func(*T))
+	preds  []Pred[T]
+	orders []Order[T]
+	offset int
+	limit  int
+}
+
+// Pred decides whether an object belongs in the results of a query.
+type Pred[T any] func(el *T) bool
+
+// Order compares two objects, like cmp.Compare does.
+type Order[T any] func(a *T, b *T) int
+
+// Select starts a query over table that read-locks the store when
+// it runs. Use from instead when the lock is already held.
+func Select[K comparable, T any](s *Store, table map[K]*T) *Query[T] {
+	q := from(table)
+	q.store = s
+	return q
+}
+
+func from[K comparable, T any](table map[K]*T) *Query[T] {
+	return &Query[T]{
+		each: func(yield func(*T)) {
+			for _, el := range table {
+				yield(el)
+			}
+		},
+	}
+}
+
+func fromSlice[T any](list []*T) *Query[T] {
+	return &Query[T]{
+		each: func(yield func(*T)) {
+			for _, el := range list {
+				yield(el)
+			}
+		},
+	}
+}
+
+// Where only keeps objects matching all of preds.
+func (q *Query[T]) Where(preds ...Pred[T]) *Query[T] {
+	q.preds = append(q.preds, preds...)
+	return q
+}
+
+// OrderBy sorts by the first of orders, then uses the next ones
+// to break ties. Without it, results come out in no particular order.
+func (q *Query[T]) OrderBy(orders ...Order[T]) *Query[T] {
+	q.orders = append(q.orders, orders...)
+	return q
+}
+
+// Offset skips the first n results.
+func (q *Query[T]) Offset(n int) *Query[T] {
+	q.offset = n
+	return q
+}
+
+// Limit returns at most n results, 0 meaning no limit.
+func (q *Query[T]) Limit(n int) *Query[T] {
+	q.limit = n
+	return q
+}
+
+// All runs the query and returns every result.
+func (q *Query[T]) All() []*T {
+	if q.store != nil {
+		q.store.mutex.RLock()
+		defer q.store.mutex.RUnlock()
+	}
+
+	var res []*T
+	q.each(func(el *T) {
+		if q.matches(el) {
+			res = append(res, el)
+		}
+	})
+
+	if len(q.orders) > 0 {
+		slices.SortStableFunc(res, func(a *T, b *T) int {
+			for _, order := range q.orders {
+				if c := order(a, b); c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+	}
+
+	if q.offset > 0 {
+		if q.offset >= len(res) {
+			return nil
+		}
+		res = res[q.offset:]
+	}
+	if q.limit > 0 && q.limit < len(res) {
+		res = res[:q.limit]
+	}
+	return res
+}
+
+// First runs the query and returns its first result, or nil.
+func (q *Query[T]) First() *T {
+	res := q.Limit(1).All()
+	if len(res) == 0 {
+		return nil
+	}
+	return res[0]
+}
+
+// Count runs the query and returns the number of results.
+func (q *Query[T]) Count() int {
+	return len(q.All())
+}
+
+func (q *Query[T]) matches(el *T) bool {
+	for _, pred := range q.preds {
+		if !pred(el) {
+			return false
+		}
+	}
+	return true
+}
+
+// Eq matches objects whose field equals v.
+func Eq[T any, V comparable](field func(*T) V, v V) Pred[T] {
+	return func(el *T) bool {
+		return field(el) == v
+	}
+}
+
+// In matches objects whose field is one of vs.
+func In[T any, V comparable](field func(*T) V, vs ...V) Pred[T] {
+	return func(el *T) bool {
+		return slices.Contains(vs, field(el))
+	}
+}
+
+// Gt matches objects whose field is greater than v.
+func Gt[T any, V cmp.Ordered](field func(*T) V, v V) Pred[T] {
+	return func(el *T) bool {
+		return field(el) > v
+	}
+}
+
+// Lt matches objects whose field is less than v.
+func Lt[T any, V cmp.Ordered](field func(*T) V, v V) Pred[T] {
+	return func(el *T) bool {
+		return field(el) < v
+	}
+}
+
+// Like matches objects whose field matches pattern, ignoring case,
+// where '%' stands for any run of characters and '_' for exactly one,
+// as in SQL.
+func Like[T any](field func(*T) string, pattern string) Pred[T] {
+	var re strings.Builder
+	re.WriteString("(?is)^")
+	for _, c := range pattern {
+		switch c {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	compiled := regexp.MustCompile(re.String())
+
+	return func(el *T) bool {
+		return compiled.MatchString(field(el))
+	}
+}
+
+// Asc sorts objects by field, smallest first.
+func Asc[T any, V cmp.Ordered](field func(*T) V) Order[T] {
+	return func(a *T, b *T) int {
+		return cmp.Compare(field(a), field(b))
+	}
+}
+
+// Desc sorts objects by field, largest first.
+func Desc[T any, V cmp.Ordered](field func(*T) V) Order[T] {
+	return func(a *T, b *T) int {
+		return cmp.Compare(field(b), field(a))
+	}
+}
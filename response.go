@@ -3,13 +3,17 @@ package mitch
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var DEBUG2 = os.Getenv("MITCH_DEBUG") == "2"
@@ -22,7 +26,8 @@ type response struct {
 	status int
 	store  *Store
 
-	currentUser *User
+	currentUser   *User
+	currentAPIKey *APIKey
 }
 
 type Any map[string]interface{}
@@ -89,8 +94,11 @@ type RespondToMap map[string]func()
 
 var (
 	validRespondToMethods = map[string]bool{
-		"GET":  true,
-		"POST": true,
+		"GET":    true,
+		"HEAD":   true,
+		"POST":   true,
+		"PUT":    true,
+		"DELETE": true,
 	}
 )
 
@@ -122,8 +130,14 @@ func (r *response) Var(name string) string {
 	return mux.Vars(r.req)[name]
 }
 
-func (r *response) CheckAPIKey() {
+// CheckAPIKey authenticates the request, and makes sure the
+// API key it uses has been granted the given scope.
+func (r *response) CheckAPIKey(scope string) {
 	keyString := r.req.Header.Get("Authorization")
+	if len(keyString) > 7 && strings.EqualFold(keyString[:7], "bearer ") {
+		// OAuth access tokens are API keys too
+		keyString = strings.TrimSpace(keyString[7:])
+	}
 	if keyString == "" {
 		keyString = r.req.URL.Query().Get("api_key")
 	}
@@ -131,12 +145,19 @@ func (r *response) CheckAPIKey() {
 		Throw(401, "authentication required")
 	}
 
-	apiKey := r.s.store.FindAPIKeysByKey(keyString)
+	apiKey := r.s.store.findAPIKeyByKey(keyString)
 	if apiKey == nil {
 		Throw(403, "unauthorized")
 	}
+	if apiKey.IsExpired(time.Now()) {
+		Throw(401, "invalid key: expired")
+	}
+	if !apiKey.HasScope(scope) {
+		Throw(403, fmt.Sprintf("invalid scope: %s required", scope))
+	}
 
-	r.currentUser = r.s.store.FindUser(apiKey.UserID)
+	r.currentAPIKey = apiKey
+	r.currentUser = r.s.store.findUser(apiKey.UserID)
 	if r.currentUser == nil {
 		Throw(500, "api key has no user")
 	}
@@ -156,6 +177,39 @@ func (r *response) Int64Param(key string) int64 {
 	return res
 }
 
+const maxPerPage = 100
+
+// PageParams returns the 1-based page and the page size requested
+// with the page and per_page params. per_page is capped to maxPerPage.
+func (r *response) PageParams(defaultPerPage int64) (page int64, perPage int64) {
+	parse := func(key string, defaultValue int64) int64 {
+		if r.Param(key) == "" {
+			return defaultValue
+		}
+		res, err := strconv.ParseInt(r.Param(key), 10, 64)
+		if err != nil || res < 1 {
+			Throw(400, fmt.Sprintf("invalid %s", key))
+		}
+		return res
+	}
+
+	page = parse("page", 1)
+	perPage = parse("per_page", defaultPerPage)
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	return
+}
+
+func (r *response) BoolParam(key string) bool {
+	switch r.Param(key) {
+	case "true", "1":
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *response) AssertAuthorization(authorized bool) {
 	if !authorized {
 		Throw(403, "forbidden")
@@ -168,24 +222,114 @@ func (r *response) RedirectTo(url string) {
 	r.WriteHeader()
 }
 
+func (r *response) ReadYAMLBody(dst interface{}) {
+	payload, err := ioutil.ReadAll(r.req.Body)
+	must(err)
+
+	err = yaml.UnmarshalStrict(payload, dst)
+	if err != nil {
+		Throw(400, fmt.Sprintf("invalid request body: %s", err.Error()))
+	}
+}
+
+// DownloadKeyParam returns the key passed as download_key_id, or nil
+// if there was none. Authorization checks are up to the caller.
+func (r *response) DownloadKeyParam() *DownloadKey {
+	param := r.Param("download_key_id")
+	if param == "" {
+		return nil
+	}
+
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		Throw(400, "invalid download_key_id")
+	}
+	dk := r.store.findDownloadKey(id)
+	if dk == nil {
+		Throw(403, "invalid download key")
+	}
+	return dk
+}
+
+func (r *response) FindUser(userID int64) *User {
+	user := r.store.findUser(userID)
+	if user == nil {
+		Throw(404, "user not found")
+	}
+	return user
+}
+
 func (r *response) FindGame(gameID int64) *Game {
-	game := r.store.FindGame(gameID)
+	game := r.store.findGame(gameID)
 	if game == nil {
 		Throw(404, "game not found")
 	}
 	return game
 }
 
+// FindViewableGame is like FindGame, but also 404s for games the
+// current user can't see, so that unpublished games look deleted.
+func (r *response) FindViewableGame(gameID int64) *Game {
+	game := r.FindGame(gameID)
+	if !game.CanBeViewedBy(r.currentUser) {
+		Throw(404, "game not found")
+	}
+	return game
+}
+
+// UpdateGameSession applies the seconds_run, crashed and last_run_at
+// params to a game session. Omitted params keep their current value,
+// except last_run_at which defaults to now.
+func (r *response) UpdateGameSession(s *UserGameSession) {
+	s.update(r.GameSessionParams(s.SecondsRun, s.Crashed))
+}
+
+// GameSessionParams reads the seconds_run, crashed and last_run_at
+// params, falling back to the given values and to now.
+func (r *response) GameSessionParams(secondsRun int64, crashed bool) (int64, bool, time.Time) {
+	if r.Param("seconds_run") != "" {
+		secondsRun = r.Int64Param("seconds_run")
+	}
+	if r.Param("crashed") != "" {
+		crashed = r.BoolParam("crashed")
+	}
+	lastRunAt := time.Now().UTC()
+	if param := r.Param("last_run_at"); param != "" {
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			Throw(400, "invalid last_run_at")
+		}
+		lastRunAt = t.UTC()
+	}
+	return secondsRun, crashed, lastRunAt
+}
+
+func (r *response) FindCollection(collectionID int64) *Collection {
+	collection := r.store.findCollection(collectionID)
+	if collection == nil {
+		Throw(404, "collection not found")
+	}
+	return collection
+}
+
 func (r *response) FindUpload(uploadID int64) *Upload {
-	upload := r.store.FindUpload(uploadID)
+	upload := r.store.findUpload(uploadID)
 	if upload == nil {
 		Throw(404, "upload not found")
 	}
 	return upload
 }
 
+// FindViewableUpload 404s if the upload's game can't be
+// seen by the current user, see FindViewableGame.
+func (r *response) FindViewableUpload(uploadID int64) *Upload {
+	upload := r.FindUpload(uploadID)
+	r.FindViewableGame(upload.GameID)
+	return upload
+}
+
 func (r *response) FindBuild(buildID int64) *Build {
-	build := r.store.FindBuild(buildID)
+	build := r.store.findBuild(buildID)
 	if build == nil {
 		Throw(404, "build not found")
 	}
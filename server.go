@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strconv"
+	pathpkg "path"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/handlers"
 	"github.com/itchio/headway/state"
@@ -24,6 +27,12 @@ import (
 type Server interface {
 	Address() net.Addr
 	Store() *Store
+
+	// SetCDNFault makes /@cdn misbehave for fault.Path, replacing
+	// any fault previously set for that path. It refuses faults
+	// that can't be applied, like a fail status that isn't one.
+	SetCDNFault(fault CDNFault) error
+	ClearCDNFaults()
 }
 
 type server struct {
@@ -33,11 +42,16 @@ type server struct {
 	opts     serverOpts
 	store    *Store
 	consumer *state.Consumer
+
+	cdnFaults      map[string]*CDNFault
+	cdnFaultsMutex sync.Mutex
 }
 
 type serverOpts struct {
-	port     int
-	consumer *state.Consumer
+	port       int
+	consumer   *state.Consumer
+	store      *Store
+	adminToken string
 }
 
 type ServerOpt func(opts *serverOpts)
@@ -54,6 +68,23 @@ func WithConsumer(consumer *state.Consumer) ServerOpt {
 	}
 }
 
+// WithStore makes the server use an existing store (for example,
+// one returned by LoadStore) instead of starting out empty.
+func WithStore(store *Store) ServerOpt {
+	return func(opts *serverOpts) {
+		opts.store = store
+	}
+}
+
+// WithAdminToken enables the /@admin routes, which let out-of-process
+// test harnesses mutate the store. Requests must carry the token in
+// an X-Admin-Token header.
+func WithAdminToken(token string) ServerOpt {
+	return func(opts *serverOpts) {
+		opts.adminToken = token
+	}
+}
+
 func NewServer(ctx context.Context, options ...ServerOpt) (Server, error) {
 	var opts serverOpts
 	for _, o := range options {
@@ -69,11 +100,18 @@ func NewServer(ctx context.Context, options ...ServerOpt) (Server, error) {
 		}
 	}
 
+	store := opts.store
+	if store == nil {
+		store = newStore()
+	}
+
 	s := &server{
 		ctx:      ctx,
 		opts:     opts,
-		store:    newStore(),
+		store:    store,
 		consumer: consumer,
+
+		cdnFaults: make(map[string]*CDNFault),
 	}
 
 	err := s.start()
@@ -112,9 +150,35 @@ func (s *server) Store() *Store {
 
 type coolHandler func(r *response)
 
+// lockMode is how much of the store's lock a handler
+// holds for the whole request.
+type lockMode int
+
+const (
+	// a read lock for GET and HEAD requests, the write lock otherwise
+	lockByMethod lockMode = iota
+	lockRead
+	// for handlers that change the store even on GET requests
+	lockWrite
+	// for handlers that only need a CDNFile, which never changes once made
+	lockNone
+)
+
+func (mode lockMode) forMethod(method string) lockMode {
+	if mode != lockByMethod {
+		return mode
+	}
+	switch method {
+	case "GET", "HEAD":
+		return lockRead
+	default:
+		return lockWrite
+	}
+}
+
 func (s *server) serve() {
 	m := mux.NewRouter()
-	handler := func(ch coolHandler) http.HandlerFunc {
+	handler := func(ch coolHandler, mode lockMode) http.HandlerFunc {
 		return func(w http.ResponseWriter, req *http.Request) {
 			res := &response{
 				s:     s,
@@ -125,6 +189,10 @@ func (s *server) serve() {
 			err := func() (retErr error) {
 				defer func() {
 					if r := recover(); r != nil {
+						if r == http.ErrAbortHandler {
+							// let net/http drop the connection
+							panic(r)
+						}
 						if rErr, ok := r.(error); ok {
 							cause := errors.Cause(rErr)
 							if ae, ok := cause.(APIError); ok {
@@ -138,6 +206,19 @@ func (s *server) serve() {
 					}
 				}()
 				must(req.ParseForm())
+				switch mode.forMethod(req.Method) {
+				case lockRead:
+					s.store.mutex.RLock()
+					defer s.store.mutex.RUnlock()
+				case lockWrite:
+					// slow clients shouldn't hold the lock while uploading
+					body, err := ioutil.ReadAll(req.Body)
+					must(err)
+					req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+					s.store.mutex.Lock()
+					defer s.store.mutex.Unlock()
+				}
 				ch(res)
 				return nil
 			}()
@@ -147,16 +228,22 @@ func (s *server) serve() {
 		}
 	}
 	route := func(route string, ch coolHandler) {
-		m.HandleFunc(route, handler(ch))
+		m.HandleFunc(route, handler(ch, lockByMethod))
+	}
+	writeRoute := func(route string, ch coolHandler) {
+		m.HandleFunc(route, handler(ch, lockWrite))
 	}
 	routePrefix := func(prefix string, ch coolHandler) {
-		m.PathPrefix(prefix).Handler(handler(ch))
+		m.PathPrefix(prefix).Handler(handler(ch, lockByMethod))
+	}
+	unlockedRoutePrefix := func(prefix string, ch coolHandler) {
+		m.PathPrefix(prefix).Handler(handler(ch, lockNone))
 	}
 
 	route("/profile", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("profile:me")
 				r.WriteJSON(Any{
 					"user": FormatUser(r.currentUser),
 				})
@@ -164,21 +251,114 @@ func (s *server) serve() {
 		})
 	})
 
-	route("/profile/game-sessions", func(r *response) {
+	route("/profile/owned-keys", func(r *response) {
 		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:owned")
+				page, perPage := r.PageParams(50)
+
+				keys := r.store.listDownloadKeysByOwner(r.currentUser.ID)
+				start, end := pageBounds(len(keys), page, perPage)
+				r.WriteJSON(Any{
+					"owned_keys": FormatDownloadKeys(keys[start:end]),
+					"page":       page,
+					"per_page":   perPage,
+				})
+			},
+		})
+	})
+
+	route("/profile/games", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:games")
+				r.WriteJSON(Any{
+					"games": FormatProfileGames(r.store.listGamesByEditor(r.currentUser)),
+				})
+			},
+		})
+	})
+
+	route("/profile/collections", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:collections")
+				page, perPage := r.PageParams(20)
+
+				collections := r.store.listCollectionsByUser(r.currentUser.ID)
+				start, end := pageBounds(len(collections), page, perPage)
+				r.WriteJSON(Any{
+					"collections": FormatCollections(collections[start:end]),
+					"page":        page,
+					"per_page":    perPage,
+				})
+			},
+		})
+	})
+
+	route("/profile/api-keys", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:me")
+				var apiKeys []*APIKey
+				for _, k := range r.store.listAPIKeysByUser(r.currentUser.ID) {
+					if r.currentAPIKey.Includes(k) {
+						apiKeys = append(apiKeys, k)
+					}
+				}
+				r.WriteJSON(Any{
+					"api_keys": FormatAPIKeys(apiKeys),
+				})
+			},
 			"POST": func() {
-				r.CheckAPIKey()
-
-				s := &UserGameSession{
-					ID:         r.store.serial(),
-					GameID:     r.Int64Param("game_id"),
-					UserID:     r.currentUser.ID,
-					Crashed:    false,
-					SecondsRun: 0,
+				r.CheckAPIKey("profile:me")
+
+				// keys can't be used to create keys with more privileges,
+				// or that outlive them
+				scopes := r.currentAPIKey.Scopes
+				if param := r.Param("scopes"); param != "" {
+					scopes = splitList(param)
+					for _, scope := range scopes {
+						r.AssertAuthorization(r.currentAPIKey.HasScope(scope))
+					}
 				}
+				apiKey := r.currentUser.makeAPIKeyWithScopes(scopes, 0)
+				apiKey.ExpiresAt = r.currentAPIKey.ExpiresAt
+				r.WriteJSON(Any{
+					"api_key": FormatAPIKey(apiKey),
+				})
+			},
+		})
+	})
+
+	route("/profile/api-keys/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"DELETE": func() {
+				r.CheckAPIKey("profile:me")
+				apiKey := r.store.findAPIKey(r.Int64Var("id"))
+				if apiKey == nil || apiKey.UserID != r.currentUser.ID {
+					Throw(404, "api key not found")
+				}
+				r.AssertAuthorization(r.currentAPIKey.Includes(apiKey))
+				r.store.deleteAPIKey(apiKey.ID)
+				r.WriteEmpty()
+			},
+		})
+	})
+
+	route("/profile/game-sessions", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAPIKey("profile:me")
+				game := r.FindViewableGame(r.Int64Param("game_id"))
+
+				// read the params first, so bad ones don't leave a session behind
+				secondsRun, crashed, lastRunAt := r.GameSessionParams(0, false)
+				s := r.currentUser.makeGameSession(game)
+				s.update(secondsRun, crashed, lastRunAt)
 				r.WriteJSON(Any{
 					"user_game_session": FormatUserGameSession(s),
-					"summary":           FormatUserGameSummary(),
+					"summary":           FormatUserGameSummary(r.store.listUserGameSessions(s.UserID, s.GameID)),
 				})
 			},
 		})
@@ -187,9 +367,9 @@ func (s *server) serve() {
 	route("/profile/game-sessions/{id}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("profile:me")
 
-				s := r.store.FindUserGameSession(r.Int64Var("id"))
+				s := r.store.findUserGameSession(r.Int64Var("id"))
 				if s == nil {
 					r.WriteError(404, "not found")
 					return
@@ -198,26 +378,101 @@ func (s *server) serve() {
 				r.AssertAuthorization(s.CanBeViewedBy(r.currentUser))
 				r.WriteJSON(Any{
 					"user_game_session": FormatUserGameSession(s),
-					"summary":           FormatUserGameSummary(),
+					"summary":           FormatUserGameSummary(r.store.listUserGameSessions(s.UserID, s.GameID)),
 				})
 			},
 			"POST": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("profile:me")
 
-				s := r.store.FindUserGameSession(r.Int64Var("id"))
+				s := r.store.findUserGameSession(r.Int64Var("id"))
 				if s == nil {
 					r.WriteError(404, "not found")
 					return
 				}
 
-				r.AssertAuthorization(s.CanBeViewedBy(r.currentUser))
-				if sr := r.Int64Param("seconds_run"); sr != 0 {
-					s.SecondsRun = sr
-				}
+				r.AssertAuthorization(s.CanBeEditedBy(r.currentUser))
+				r.UpdateGameSession(s)
 
 				r.WriteJSON(Any{
 					"user_game_session": FormatUserGameSession(s),
-					"summary":           FormatUserGameSummary(),
+					"summary":           FormatUserGameSummary(r.store.listUserGameSessions(s.UserID, s.GameID)),
+				})
+			},
+		})
+	})
+
+	route("/search/games", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("game:view")
+				page, perPage := r.PageParams(20)
+
+				var games []*Game
+				for _, g := range r.store.searchGames(r.Param("query")) {
+					if g.CanBeViewedBy(r.currentUser) {
+						games = append(games, g)
+					}
+				}
+				start, end := pageBounds(len(games), page, perPage)
+				r.WriteJSON(Any{
+					"games":    FormatGames(games[start:end]),
+					"page":     page,
+					"per_page": perPage,
+				})
+			},
+		})
+	})
+
+	route("/search/users", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:me")
+				page, perPage := r.PageParams(20)
+
+				users := r.store.searchUsers(r.Param("query"))
+				start, end := pageBounds(len(users), page, perPage)
+				r.WriteJSON(Any{
+					"users":    FormatUsers(users[start:end]),
+					"page":     page,
+					"per_page": perPage,
+				})
+			},
+		})
+	})
+
+	route("/collections/{id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:collections")
+				collection := r.FindCollection(r.Int64Var("id"))
+				r.AssertAuthorization(collection.CanBeViewedBy(r.currentUser))
+				r.WriteJSON(Any{
+					"collection": FormatCollection(collection),
+				})
+			},
+		})
+	})
+
+	route("/collections/{id}/collection-games", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("profile:collections")
+				collection := r.FindCollection(r.Int64Var("id"))
+				r.AssertAuthorization(collection.CanBeViewedBy(r.currentUser))
+				page, perPage := r.PageParams(20)
+
+				var cgs []*CollectionGame
+				for _, cg := range r.store.listCollectionGamesByCollection(collection.ID) {
+					game := r.store.findGame(cg.GameID)
+					if game != nil && game.CanBeViewedBy(r.currentUser) {
+						cgs = append(cgs, cg)
+					}
+				}
+				start, end := pageBounds(len(cgs), page, perPage)
+				r.WriteJSON(Any{
+					"collection_games": FormatCollectionGames(cgs[start:end]),
+					"page":             page,
+					"per_page":         perPage,
 				})
 			},
 		})
@@ -226,10 +481,9 @@ func (s *server) serve() {
 	route("/games/{id}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				gameID := r.Int64Var("id")
-				game := r.FindGame(gameID)
-				r.AssertAuthorization(game.CanBeViewedBy(r.currentUser))
+				game := r.FindViewableGame(gameID)
 				r.WriteJSON(Any{
 					"game": FormatGame(game),
 				})
@@ -240,11 +494,16 @@ func (s *server) serve() {
 	route("/games/{id}/uploads", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				gameID := r.Int64Var("id")
-				game := r.FindGame(gameID)
-				r.AssertAuthorization(game.CanBeViewedBy(r.currentUser))
-				uploads := r.store.ListUploadsByGame(gameID)
+				game := r.FindViewableGame(gameID)
+				r.AssertAuthorization(game.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
+				var uploads []*Upload
+				for _, u := range r.store.listUploadsByGame(gameID) {
+					if u.IsListedFor(r.currentUser) {
+						uploads = append(uploads, u)
+					}
+				}
 				r.WriteJSON(Any{
 					"uploads": FormatUploads(uploads),
 				})
@@ -255,11 +514,11 @@ func (s *server) serve() {
 	route("/uploads/{id}/builds", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				uploadID := r.Int64Var("id")
-				upload := r.FindUpload(uploadID)
-				r.AssertAuthorization(upload.CanBeViewedBy(r.currentUser))
-				builds := r.store.ListBuildsByUpload(uploadID)
+				upload := r.FindViewableUpload(uploadID)
+				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
+				builds := r.store.listBuildsByUpload(uploadID)
 				r.WriteJSON(Any{
 					"builds": FormatBuilds(builds),
 				})
@@ -270,10 +529,9 @@ func (s *server) serve() {
 	route("/games/{id}/download-sessions", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"POST": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				gameID := r.Int64Var("id")
-				game := r.store.FindGame(gameID)
-				r.AssertAuthorization(game.CanBeViewedBy(r.currentUser))
+				r.FindViewableGame(gameID)
 				r.WriteJSON(Any{
 					"uuid": uuid.New().String(),
 				})
@@ -284,10 +542,12 @@ func (s *server) serve() {
 	route("/uploads/{id}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				uploadID := r.Int64Var("id")
-				upload := r.FindUpload(uploadID)
-				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser))
+				upload := r.FindViewableUpload(uploadID)
+				// pre-order uploads can be looked at, just not downloaded
+				game := r.FindGame(upload.GameID)
+				r.AssertAuthorization(game.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
 				res := Any{
 					"upload": FormatUpload(upload),
 				}
@@ -299,16 +559,16 @@ func (s *server) serve() {
 	route("/uploads/{id}/download", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				uploadID := r.Int64Var("id")
-				upload := r.FindUpload(uploadID)
-				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser))
+				upload := r.FindViewableUpload(uploadID)
+				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
 				switch upload.Storage {
 				case "hosted":
 					r.ServeCDNAsset(upload)
 				case "build":
 					build := r.FindBuild(upload.Head)
-					archive := build.GetFile("archive", "default")
+					archive := build.getFile("archive", "default")
 					if archive == nil {
 						Throw(404, "no archive for build")
 					}
@@ -323,12 +583,12 @@ func (s *server) serve() {
 	route("/builds/{id}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 				buildID := r.Int64Var("id")
 				build := r.FindBuild(buildID)
 
-				upload := r.FindUpload(build.UploadID)
-				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser))
+				upload := r.FindViewableUpload(build.UploadID)
+				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
 				res := Any{
 					"build": FormatBuild(build),
 				}
@@ -340,16 +600,16 @@ func (s *server) serve() {
 	route("/builds/{id}/download/{type}/{subtype}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 
 				buildID := r.Int64Var("id")
 				build := r.FindBuild(buildID)
-				upload := r.FindUpload(build.UploadID)
-				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser))
+				upload := r.FindViewableUpload(build.UploadID)
+				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
 
 				typ := r.Var("type")
 				subtype := r.Var("subtype")
-				bf := build.GetFile(typ, subtype)
+				bf := build.getFile(typ, subtype)
 				if bf == nil {
 					log.Printf("no build file found for %s/%s for build %d", typ, subtype, build.ID)
 					Throw(404, fmt.Sprintf("no %s/%s build file", typ, subtype))
@@ -362,11 +622,13 @@ func (s *server) serve() {
 	route("/builds/{id}/upgrade-paths/{target_id}", func(r *response) {
 		r.RespondTo(RespondToMap{
 			"GET": func() {
-				r.CheckAPIKey()
+				r.CheckAPIKey("game:view")
 
 				id := r.Int64Var("id")
 				targetID := r.Int64Var("target_id")
 				targetBuild := r.FindBuild(targetID)
+				upload := r.FindViewableUpload(targetBuild.UploadID)
+				r.AssertAuthorization(upload.CanBeDownloadedBy(r.currentUser, r.DownloadKeyParam()))
 
 				curr := targetBuild
 				builds := []*Build{curr}
@@ -395,13 +657,9 @@ func (s *server) serve() {
 				var formattedBuilds []Any
 				for _, b := range builds {
 					item := FormatBuild(b)
-					patches := s.store.SelectBuildFiles(
-						NoSort(),
-						Eq{
-							"BuildID": b.ID,
-							"Type":    "patch",
-						},
-					)
+					patches := from(s.store.BuildFiles).
+						Where(func(bf *BuildFile) bool { return bf.BuildID == b.ID && bf.Type == "patch" }).
+						All()
 					var files []Any
 					for _, p := range patches {
 						files = append(files, FormatBuildFile(p))
@@ -419,57 +677,135 @@ func (s *server) serve() {
 		})
 	})
 
-	routePrefix("/@cdn", func(r *response) {
+	s.loginRoutes(route)
+	s.oauthRoutes(route, writeRoute)
+	s.wharfRoutes(route)
+	s.adminRoutes(route)
+
+	routePrefix("/@upload", func(r *response) {
+		path := strings.TrimPrefix(r.req.URL.Path, "/@upload")
+
 		r.RespondTo(RespondToMap{
-			"GET": func() {
-				path := r.req.URL.Path
-				path = strings.TrimPrefix(path, "/@cdn")
-				f := r.store.CDNFiles[path]
-				if f == nil {
-					Throw(404, "not found")
+			"POST": func() {
+				if r.req.Header.Get("x-goog-resumable") != "start" {
+					Throw(400, "expected x-goog-resumable: start")
+				}
+				if r.store.findPendingBuildFileByCDNPath(path) == nil {
+					Throw(404, "nothing to upload here")
 				}
 
-				contentLength := f.Size
-				rangeHeader := r.req.Header.Get("Range")
-				data := f.Contents
-				if rangeHeader == "" {
-					r.status = 200
-				} else {
-					rangeTokens := strings.Split(rangeHeader, "=")
-					byteTokens := strings.Split(rangeTokens[1], "-")
-
-					start := int64(0)
-					if startVal, err := strconv.ParseInt(byteTokens[0], 10, 64); err == nil {
-						start = startVal
+				us := r.store.makeUploadSession(path)
+				r.Header().Set("Location", r.makeURL("/@upload%s?upload_id=%s", path, us.ID))
+				r.status = 201
+				r.WriteHeader()
+			},
+			"PUT": func() {
+				contents, err := ioutil.ReadAll(r.req.Body)
+				must(err)
+
+				uploadID := r.Param("upload_id")
+				if uploadID == "" {
+					// not resumable, take the whole body at once, but
+					// only where an upload was handed out
+					if r.store.findPendingBuildFileByCDNPath(path) == nil && r.store.findUploadSessionByPath(path) == nil {
+						Throw(404, "nothing to upload here")
 					}
-					end := f.Size - 1
-					if endVal, err := strconv.ParseInt(byteTokens[1], 10, 64); err == nil {
-						end = endVal
+					r.store.uploadCDNFile(path, pathpkg.Base(path), contents)
+					r.WriteJSON(Any{})
+					return
+				}
+
+				us := r.store.UploadSessions[uploadID]
+				if us == nil || us.Path != path {
+					Throw(404, "upload session not found")
+				}
+
+				cr, err := parseContentRange(r.req.Header.Get("Content-Range"))
+				if err != nil {
+					Throw(400, err.Error())
+				}
+
+				if cr.start >= 0 {
+					if int64(len(contents)) != cr.end+1-cr.start {
+						Throw(400, "content-range does not match body length")
 					}
+					err = us.Write(cr.start, contents, cr.total)
+					if err != nil {
+						Throw(400, err.Error())
+					}
+				}
 
-					// note that the server will return internal error if the range is invalid
-					data = data[start : end+1]
-					contentLength = end + 1 - start
-					r.status = 206
-					r.Header().Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, f.Size))
+				if cr.total >= 0 {
+					if us.Offset() > cr.total {
+						Throw(400, "upload is larger than announced total size")
+					}
+					if us.Offset() == cr.total {
+						us.commit(r.store)
+						r.WriteJSON(Any{})
+						return
+					}
 				}
 
-				r.Header().Set("content-length", fmt.Sprintf("%d", contentLength))
-				r.Header().Set("accept-range", "bytes")
-				r.Header().Set("content-type", "application/octet-stream")
-				r.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
-				r.Header().Set("connection", "close")
+				// 308 Resume Incomplete
+				if us.Offset() > 0 {
+					r.Header().Set("Range", fmt.Sprintf("bytes=0-%d", us.Offset()-1))
+				}
+				r.status = 308
 				r.WriteHeader()
-
-				src := bytes.NewReader(data)
-				r.s.Debugf("Serving %s", f.Filename)
-				// ignore closed connections
-				_, _ = io.Copy(r.w, src)
-				r.s.Debugf("Serving %s (done)", f.Filename)
 			},
 		})
 	})
 
+	unlockedRoutePrefix("/@cdn", func(r *response) {
+		serve := func() {
+			path := r.req.URL.Path
+			path = strings.TrimPrefix(path, "/@cdn")
+			f := r.store.FindCDNFile(path)
+			if f == nil {
+				Throw(404, "not found")
+			}
+
+			w := r.w
+			data := f.Contents
+			if !isValidRangeHeader(r.req.Header.Get("Range")) {
+				r.req.Header.Del("Range")
+			}
+
+			fault := r.s.takeCDNFault(path)
+			if fault != nil {
+				r.applyCDNFault(fault)
+				if fault.IgnoreRange {
+					r.req.Header.Del("Range")
+				}
+				data = fault.corrupt(data)
+				if fault.DropAfter > 0 {
+					w = &droppingWriter{ResponseWriter: w, r: r, remaining: fault.DropAfter}
+				}
+			}
+
+			r.Header().Set("content-type", "application/octet-stream")
+			r.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", f.Filename))
+			r.Header().Set("connection", "close")
+			if f.MD5 != "" {
+				r.Header().Set("etag", fmt.Sprintf("%q", f.MD5))
+				if md5Sum, err := hex.DecodeString(f.MD5); err == nil {
+					r.Header().Set("x-goog-hash", "md5="+base64.StdEncoding.EncodeToString(md5Sum))
+				}
+			}
+
+			r.s.Debugf("Serving %s", f.Filename)
+			// takes care of Range, If-Range, HEAD, 416 responses,
+			// and conditional requests (If-None-Match, If-Modified-Since)
+			http.ServeContent(w, r.req, f.Filename, f.UploadedAt, bytes.NewReader(data))
+			r.s.Debugf("Serving %s (done)", f.Filename)
+		}
+
+		r.RespondTo(RespondToMap{
+			"GET":  serve,
+			"HEAD": serve,
+		})
+	})
+
 	routePrefix("/", func(r *response) {
 		Throw(404, "invalid api endpoint")
 	})
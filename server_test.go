@@ -0,0 +1,578 @@
+package mitch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test_ConcurrentAccess seeds the store while it's being queried,
+// directly and over HTTP. It's mostly useful with -race.
+func Test_ConcurrentAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	viewer := store.MakeUser("Viewer")
+	apiKey := viewer.MakeAPIKey()
+
+	const rounds = 20
+	games := make(chan int64)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(games)
+		for i := 0; i < rounds; i++ {
+			dev := store.MakeUser(fmt.Sprintf("Developer %d", i))
+			dev.MakeAPIKey()
+			game := dev.MakeGame(fmt.Sprintf("Game %d", i))
+			game.Publish()
+			upload := game.MakeUpload("All platforms")
+			upload.SetAllPlatforms()
+			if i%2 == 0 {
+				upload.SetZipContents()
+			} else {
+				upload.PushBuild(func(ac *ArchiveContext) {
+					ac.Entry("hello.txt").String("Just a test file")
+				})
+			}
+			games <- game.ID
+		}
+	}()
+
+	get := func(path string) {
+		res, err := http.Get(fmt.Sprintf("http://%s%s?api_key=%s", srv.Address(), path, apiKey.Key))
+		if assert.NoError(err) {
+			res.Body.Close()
+			assert.EqualValues(200, res.StatusCode, path)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for gameID := range games {
+				if game := store.FindGame(gameID); assert.NotNil(game) {
+					assert.Len(store.ListUploadsByGame(game.ID), 1)
+				}
+				store.SearchGames("game")
+				store.SearchUsers("developer")
+
+				get("/profile")
+				get("/search/games")
+				get(fmt.Sprintf("/games/%d", gameID))
+				get(fmt.Sprintf("/games/%d/uploads", gameID))
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Len(store.SearchGames("game"), rounds)
+}
+
+func Test_DeleteAndUnpublish(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx, WithAdminToken("admin-token"))
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Developer")
+	devKey := dev.MakeAPIKey()
+	player := store.MakeUser("Player")
+	playerKey := player.MakeAPIKey()
+
+	game := dev.MakeGame("Fleeting")
+	game.Publish()
+	upload := game.MakeUpload("All platforms")
+	upload.SetAllPlatforms()
+	build := upload.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("hello.txt").String("Just a test file")
+	})
+	archive := build.GetFile("archive", "default")
+
+	do := func(method string, path string, apiKey *APIKey) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", srv.Address(), path), nil)
+		assert.NoError(err)
+		if apiKey != nil {
+			req.Header.Set("Authorization", apiKey.Key)
+		} else {
+			req.Header.Set("X-Admin-Token", "admin-token")
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	paths := []string{
+		fmt.Sprintf("/games/%d", game.ID),
+		fmt.Sprintf("/games/%d/uploads", game.ID),
+		fmt.Sprintf("/uploads/%d", upload.ID),
+		fmt.Sprintf("/uploads/%d/builds", upload.ID),
+		fmt.Sprintf("/builds/%d", build.ID),
+	}
+	for _, path := range paths {
+		assert.EqualValues(200, do("GET", path, playerKey), path)
+	}
+
+	assert.EqualValues(200, do("POST", fmt.Sprintf("/@admin/games/%d/unpublish", game.ID), nil))
+	for _, path := range paths {
+		assert.EqualValues(404, do("GET", path, playerKey), path)
+		assert.EqualValues(200, do("GET", path, devKey), path)
+	}
+
+	assert.EqualValues(204, do("DELETE", fmt.Sprintf("/@admin/games/%d", game.ID), nil))
+	assert.EqualValues(404, do("DELETE", fmt.Sprintf("/@admin/games/%d", game.ID), nil))
+	for _, path := range paths {
+		assert.EqualValues(404, do("GET", path, devKey), path)
+	}
+	assert.EqualValues(404, do("GET", "/@cdn"+archive.CDNPath(), devKey))
+}
+
+// apiRequest sends form to path, authenticated with apiKey if it's not
+// empty, and decodes the response if it's JSON.
+func apiRequest(t *testing.T, srv Server, method string, path string, apiKey string, form url.Values) (int, Any) {
+	header := make(http.Header)
+	if apiKey != "" {
+		header.Set("Authorization", apiKey)
+	}
+	return formRequest(t, srv, method, path, header, form)
+}
+
+// adminRequest is like apiRequest, for servers made WithAdminToken("admin-token")
+func adminRequest(t *testing.T, srv Server, method string, path string, form url.Values) (int, Any) {
+	header := make(http.Header)
+	header.Set("X-Admin-Token", "admin-token")
+	return formRequest(t, srv, method, path, header, form)
+}
+
+func formRequest(t *testing.T, srv Server, method string, path string, header http.Header, form url.Values) (int, Any) {
+	var body string
+	switch method {
+	case "POST", "PUT", "PATCH":
+		body = form.Encode()
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		if len(form) > 0 {
+			path += "?" + form.Encode()
+		}
+	}
+	return bodyRequest(t, srv, method, path, header, strings.NewReader(body))
+}
+
+func bodyRequest(t *testing.T, srv Server, method string, path string, header http.Header, body io.Reader) (int, Any) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", srv.Address(), path), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload Any
+	if strings.Contains(res.Header.Get("Content-Type"), "json") && len(bytes.TrimSpace(resBody)) > 0 {
+		err = json.Unmarshal(resBody, &payload)
+		if err != nil {
+			t.Fatalf("%s %s: %v (%q)", method, path, err, resBody)
+		}
+	}
+	return res.StatusCode, payload
+}
+
+func Test_PageBounds(t *testing.T) {
+	assert := assert.New(t)
+
+	bounds := func(total int, page int64, perPage int64) []int {
+		start, end := pageBounds(total, page, perPage)
+		return []int{start, end}
+	}
+
+	assert.EqualValues([]int{0, 20}, bounds(45, 1, 20))
+	assert.EqualValues([]int{40, 45}, bounds(45, 3, 20))
+	assert.EqualValues([]int{45, 45}, bounds(45, 4, 20))
+	assert.EqualValues([]int{0, 0}, bounds(0, 1, 20))
+	assert.EqualValues([]int{0, 1}, bounds(45, 0, 0))
+	assert.EqualValues([]int{0, 1}, bounds(45, -5, -5))
+
+	const maxInt64 = int64(^uint64(0) >> 1)
+	assert.EqualValues([]int{45, 45}, bounds(45, maxInt64, 20))
+	assert.EqualValues([]int{45, 45}, bounds(45, 1<<62, 1<<62))
+	assert.EqualValues([]int{0, 45}, bounds(45, 1, maxInt64))
+	assert.EqualValues([]int{45, 45}, bounds(45, 2, maxInt64))
+}
+
+func Test_OwnedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Developer")
+	buyer := store.MakeUser("Buyer")
+	apiKey := buyer.MakeAPIKey().Key
+	var keyIDs []interface{}
+	for i := 0; i < 5; i++ {
+		game := dev.MakeGame(fmt.Sprintf("Game %d", i))
+		game.Publish()
+		// newest first
+		keyIDs = append([]interface{}{float64(buyer.BuyGame(game).ID)}, keyIDs...)
+	}
+	dev.BuyGame(dev.MakeGame("Someone else's"))
+
+	ownedKeys := func(form url.Values) []interface{} {
+		status, payload := apiRequest(t, srv, "GET", "/profile/owned-keys", apiKey, form)
+		assert.EqualValues(200, status, form.Encode())
+		var ids []interface{}
+		for _, dk := range payload["owned_keys"].([]interface{}) {
+			dk := dk.(map[string]interface{})
+			assert.NotNil(dk["game"])
+			ids = append(ids, dk["id"])
+		}
+		return ids
+	}
+
+	assert.EqualValues(keyIDs, ownedKeys(nil))
+	assert.EqualValues(keyIDs[:2], ownedKeys(url.Values{"per_page": {"2"}}))
+	assert.EqualValues(keyIDs[2:4], ownedKeys(url.Values{"per_page": {"2"}, "page": {"2"}}))
+	assert.EqualValues(keyIDs[4:], ownedKeys(url.Values{"per_page": {"2"}, "page": {"3"}}))
+	assert.Empty(ownedKeys(url.Values{"per_page": {"2"}, "page": {"4"}}))
+	assert.Empty(ownedKeys(url.Values{"page": {"9223372036854775807"}}))
+
+	status, payload := apiRequest(t, srv, "GET", "/profile/owned-keys", apiKey, url.Values{"per_page": {"100000"}})
+	assert.EqualValues(200, status)
+	assert.EqualValues(maxPerPage, payload["per_page"])
+
+	for _, form := range []url.Values{
+		{"page": {"0"}},
+		{"page": {"-1"}},
+		{"per_page": {"0"}},
+		{"page": {"first"}},
+		{"per_page": {"99999999999999999999"}},
+	} {
+		status, _ := apiRequest(t, srv, "GET", "/profile/owned-keys", apiKey, form)
+		assert.EqualValues(400, status, form.Encode())
+	}
+}
+
+func Test_Collections(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Developer")
+	published := dev.MakeGame("Published")
+	published.Publish()
+	draft := dev.MakeGame("Draft")
+
+	collector := store.MakeUser("Collector")
+	apiKey := collector.MakeAPIKey().Key
+	favorites := collector.MakeCollection("Favorites")
+	favorites.AddGame(draft)
+	favorites.AddGame(published)
+	collector.MakeCollection("Wishlist")
+	collector.MakeCollection("Backlog")
+	private := dev.MakeCollection("Private")
+
+	titles := func(form url.Values) []interface{} {
+		status, payload := apiRequest(t, srv, "GET", "/profile/collections", apiKey, form)
+		assert.EqualValues(200, status)
+		var res []interface{}
+		for _, c := range payload["collections"].([]interface{}) {
+			res = append(res, c.(map[string]interface{})["title"])
+		}
+		return res
+	}
+	assert.EqualValues([]interface{}{"Favorites", "Wishlist", "Backlog"}, titles(nil))
+	assert.EqualValues([]interface{}{"Favorites", "Wishlist"}, titles(url.Values{"per_page": {"2"}}))
+	assert.EqualValues([]interface{}{"Backlog"}, titles(url.Values{"per_page": {"2"}, "page": {"2"}}))
+	assert.Empty(titles(url.Values{"page": {"2"}}))
+	status, _ := apiRequest(t, srv, "GET", "/profile/collections", apiKey, url.Values{"page": {"0"}})
+	assert.EqualValues(400, status)
+
+	status, payload := apiRequest(t, srv, "GET", fmt.Sprintf("/collections/%d", favorites.ID), apiKey, nil)
+	assert.EqualValues(200, status)
+	collection := payload["collection"].(map[string]interface{})
+	assert.EqualValues("Favorites", collection["title"])
+	assert.EqualValues(2, collection["games_count"])
+
+	status, payload = apiRequest(t, srv, "GET", fmt.Sprintf("/collections/%d/collection-games", favorites.ID), apiKey, nil)
+	assert.EqualValues(200, status)
+	cgs := payload["collection_games"].([]interface{})
+	if assert.Len(cgs, 1, "unpublished games aren't listed") {
+		cg := cgs[0].(map[string]interface{})
+		assert.EqualValues(2, cg["position"])
+		assert.EqualValues(published.ID, cg["game"].(map[string]interface{})["id"])
+	}
+
+	for _, path := range []string{
+		fmt.Sprintf("/collections/%d", private.ID),
+		fmt.Sprintf("/collections/%d/collection-games", private.ID),
+	} {
+		status, _ = apiRequest(t, srv, "GET", path, apiKey, nil)
+		assert.EqualValues(403, status, path)
+	}
+	status, _ = apiRequest(t, srv, "GET", "/collections/1", apiKey, nil)
+	assert.EqualValues(404, status)
+}
+
+func Test_GameSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Developer")
+	game := dev.MakeGame("Played")
+	game.Publish()
+	player := store.MakeUser("Player")
+	apiKey := player.MakeAPIKey().Key
+
+	post := func(path string, form url.Values) (int, map[string]interface{}, map[string]interface{}) {
+		status, payload := apiRequest(t, srv, "POST", path, apiKey, form)
+		if status != 200 {
+			return status, nil, nil
+		}
+		return status, payload["user_game_session"].(map[string]interface{}), payload["summary"].(map[string]interface{})
+	}
+	gameID := fmt.Sprintf("%d", game.ID)
+
+	status, session, summary := post("/profile/game-sessions", url.Values{
+		"game_id":     {gameID},
+		"seconds_run": {"60"},
+		"crashed":     {"true"},
+		"last_run_at": {"2020-01-02T03:04:05Z"},
+	})
+	assert.EqualValues(200, status)
+	firstID := int64(session["id"].(float64))
+	assert.EqualValues(game.ID, session["game_id"])
+	assert.EqualValues(player.ID, session["user_id"])
+	assert.EqualValues(60, session["seconds_run"])
+	assert.EqualValues(true, session["crashed"])
+	assert.EqualValues("2020-01-02T03:04:05Z", session["last_run_at"])
+	assert.EqualValues(map[string]interface{}{
+		"seconds_run": float64(60),
+		"last_run_at": "2020-01-02T03:04:05Z",
+	}, summary)
+	persisted := store.ListUserGameSessions(player.ID, game.ID)
+	if assert.Len(persisted, 1) {
+		assert.EqualValues(60, persisted[0].SecondsRun)
+		assert.True(persisted[0].Crashed)
+	}
+
+	status, _, _ = post("/profile/game-sessions", url.Values{
+		"game_id":     {gameID},
+		"last_run_at": {"yesterday"},
+	})
+	assert.EqualValues(400, status)
+	assert.Len(store.ListUserGameSessions(player.ID, game.ID), 1, "invalid sessions aren't created")
+
+	status, session, summary = post("/profile/game-sessions", url.Values{
+		"game_id":     {gameID},
+		"seconds_run": {"30"},
+		"last_run_at": {"2021-01-01T00:00:00Z"},
+	})
+	assert.EqualValues(200, status)
+	assert.EqualValues(false, session["crashed"])
+	assert.EqualValues(90, summary["seconds_run"])
+	assert.EqualValues("2021-01-01T00:00:00Z", summary["last_run_at"])
+
+	// updates keep what isn't given, but last_run_at defaults to now
+	path := fmt.Sprintf("/profile/game-sessions/%d", firstID)
+	before := time.Now().UTC().Add(-time.Second)
+	status, session, summary = post(path, url.Values{"seconds_run": {"120"}})
+	assert.EqualValues(200, status)
+	assert.EqualValues(120, session["seconds_run"])
+	assert.EqualValues(true, session["crashed"])
+	lastRunAt, err := time.Parse(time.RFC3339, session["last_run_at"].(string))
+	assert.NoError(err)
+	assert.True(lastRunAt.After(before))
+	assert.EqualValues(150, summary["seconds_run"])
+	assert.EqualValues(session["last_run_at"], summary["last_run_at"])
+
+	status, _, _ = post(path, url.Values{"seconds_run": {"1"}, "last_run_at": {"2020-13-45"}})
+	assert.EqualValues(400, status)
+	status, payload := apiRequest(t, srv, "GET", path, apiKey, nil)
+	assert.EqualValues(200, status)
+	assert.EqualValues(120, payload["user_game_session"].(map[string]interface{})["seconds_run"])
+	assert.EqualValues(150, payload["summary"].(map[string]interface{})["seconds_run"])
+
+	otherKey := dev.MakeAPIKey().Key
+	status, _ = apiRequest(t, srv, "GET", path, otherKey, nil)
+	assert.EqualValues(403, status)
+	status, _ = apiRequest(t, srv, "POST", path, otherKey, url.Values{"seconds_run": {"0"}})
+	assert.EqualValues(403, status)
+	status, _ = apiRequest(t, srv, "GET", "/profile/game-sessions/1", apiKey, nil)
+	assert.EqualValues(404, status)
+}
+
+func Test_Search(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	other := store.MakeUser("Space Other")
+	first := other.MakeGame("Space Race")
+	first.Publish()
+	other.MakeGame("Space Secret")
+	searcher := store.MakeUser("Space Searcher")
+	apiKey := searcher.MakeAPIKey().Key
+	mine := searcher.MakeGame("Space Draft")
+	last := other.MakeGame("Space Invaders")
+	last.Publish()
+	other.MakeGame("Unrelated").Publish()
+
+	ids := func(path string, key string, form url.Values) []int64 {
+		status, payload := apiRequest(t, srv, "GET", path, apiKey, form)
+		assert.EqualValues(200, status)
+		var res []int64
+		for _, item := range payload[key].([]interface{}) {
+			res = append(res, int64(item.(map[string]interface{})["id"].(float64)))
+		}
+		return res
+	}
+
+	// other users' drafts are left out, our own aren't
+	assert.EqualValues([]int64{first.ID, mine.ID, last.ID}, ids("/search/games", "games", url.Values{"query": {"space"}}))
+	assert.EqualValues([]int64{first.ID, mine.ID}, ids("/search/games", "games", url.Values{"query": {"SPACE"}, "per_page": {"2"}}))
+	assert.EqualValues([]int64{last.ID}, ids("/search/games", "games", url.Values{"query": {"space"}, "per_page": {"2"}, "page": {"2"}}))
+	assert.Empty(ids("/search/games", "games", url.Values{"query": {"secret"}}))
+
+	store.MakeUser("Unrelated")
+	assert.EqualValues([]int64{other.ID, searcher.ID}, ids("/search/users", "users", url.Values{"query": {"space"}}))
+	assert.EqualValues([]int64{searcher.ID}, ids("/search/users", "users", url.Values{"query": {"space"}, "per_page": {"1"}, "page": {"2"}}))
+	assert.EqualValues([]int64{searcher.ID}, ids("/search/users", "users", url.Values{"query": {"space-searcher"}}))
+
+	status, _ := apiRequest(t, srv, "GET", "/search/games", apiKey, url.Values{"query": {"space"}, "per_page": {"lots"}})
+	assert.EqualValues(400, status)
+
+	// each endpoint needs its own scope
+	gamesKey := searcher.MakeAPIKeyWithScopes([]string{"game:view"}, 0).Key
+	status, _ = apiRequest(t, srv, "GET", "/search/games", gamesKey, url.Values{"query": {"space"}})
+	assert.EqualValues(200, status)
+	status, _ = apiRequest(t, srv, "GET", "/search/users", gamesKey, url.Values{"query": {"space"}})
+	assert.EqualValues(403, status)
+	usersKey := searcher.MakeAPIKeyWithScopes([]string{"profile:me"}, 0).Key
+	status, _ = apiRequest(t, srv, "GET", "/search/users", usersKey, url.Values{"query": {"space"}})
+	assert.EqualValues(200, status)
+	status, _ = apiRequest(t, srv, "GET", "/search/games", usersKey, url.Values{"query": {"space"}})
+	assert.EqualValues(403, status)
+}
+
+func Test_HandlerLocking(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+	user := store.MakeUser("Reader")
+	apiKey := user.MakeAPIKey().Key
+
+	// fails the test instead of hanging if the request can't get the lock
+	within := func(what string, f func()) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out", what)
+		}
+	}
+
+	// read-only requests only need a read lock, so they
+	// go through while something else is reading the store
+	store.mutex.RLock()
+	within("GET while read-locked", func() {
+		status, _ := apiRequest(t, srv, "GET", "/profile", apiKey, nil)
+		assert.EqualValues(200, status)
+	})
+	store.mutex.RUnlock()
+
+	// request bodies are read before taking the lock,
+	// so slow uploads don't block everyone else
+	uploadURL := wharfUploadURL(t, srv, user, "")
+	bodyReader, bodyWriter := io.Pipe()
+	uploadDone := make(chan int)
+	go func() {
+		req, err := http.NewRequest("PUT", uploadURL, bodyReader)
+		if !assert.NoError(err) {
+			close(uploadDone)
+			return
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			close(uploadDone)
+			return
+		}
+		res.Body.Close()
+		uploadDone <- res.StatusCode
+	}()
+	_, err = bodyWriter.Write([]byte("first half, "))
+	assert.NoError(err)
+
+	within("requests during a slow upload", func() {
+		status, _ := apiRequest(t, srv, "GET", "/profile", apiKey, nil)
+		assert.EqualValues(200, status)
+		status, _ = apiRequest(t, srv, "POST", "/profile/api-keys", apiKey, nil)
+		assert.EqualValues(200, status)
+	})
+
+	_, err = bodyWriter.Write([]byte("second half"))
+	assert.NoError(err)
+	assert.NoError(bodyWriter.Close())
+	within("slow upload", func() {
+		assert.EqualValues(200, <-uploadDone)
+	})
+	uploadPath := strings.TrimPrefix(uploadURL, fmt.Sprintf("http://%s/@upload", srv.Address()))
+	assert.EqualValues("first half, second half", string(store.FindCDNFile(uploadPath).Contents))
+}
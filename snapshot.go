@@ -0,0 +1,76 @@
+package mitch
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// storeSnapshot is what Save writes and LoadStore reads: every
+// exported table of the store, plus the ID seed so that objects
+// created after a reload don't collide with existing ones.
+type storeSnapshot struct {
+	IDSeed int64
+	Store  *Store
+}
+
+// Save writes a JSON snapshot of the whole store, CDN files included.
+func (s *Store) Save(w io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(&storeSnapshot{
+		IDSeed: s.idSeed,
+		Store:  s,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// LoadStore reads a snapshot written by Store.Save
+func LoadStore(r io.Reader) (*Store, error) {
+	snap := &storeSnapshot{
+		Store: newStore(),
+	}
+	err := json.NewDecoder(r).Decode(snap)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s := snap.Store
+	s.idSeed = snap.IDSeed
+	s.relink()
+	s.reindex()
+	return s, nil
+}
+
+// relink sets the Store back-pointer of every object
+// in the store's tables, since those aren't serialized.
+func (s *Store) relink() {
+	storeVal := reflect.ValueOf(s)
+	sVal := storeVal.Elem()
+	for i := 0; i < sVal.NumField(); i++ {
+		field := sVal.Field(i)
+		if field.Kind() != reflect.Map || !field.CanSet() {
+			continue
+		}
+
+		iter := field.MapRange()
+		for iter.Next() {
+			el := iter.Value()
+			if el.Kind() != reflect.Ptr {
+				continue
+			}
+			storeField := el.Elem().FieldByName("Store")
+			if storeField.IsValid() && storeField.Type() == storeVal.Type() {
+				storeField.Set(storeVal)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package mitch
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_SaveLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	user := s.MakeUser("Snapshot user")
+	game := user.MakeGame("Snapshot game")
+	upload := game.MakeUpload("All platforms")
+	upload.SetAllPlatforms()
+	upload.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("data.bin").Random(0x1, 4096)
+	})
+
+	buf := new(bytes.Buffer)
+	assert.NoError(s.Save(buf))
+
+	s2, err := LoadStore(buf)
+	assert.NoError(err)
+
+	assert.EqualValues(len(s.CDNFiles), len(s2.CDNFiles))
+	for path, f := range s.CDNFiles {
+		assert.EqualValues(f.Contents, s2.CDNFiles[path].Contents)
+	}
+
+	upload2 := s2.FindUpload(upload.ID)
+	assert.NotNil(upload2)
+	assert.True(upload2.Store == s2)
+	assert.EqualValues(upload.Head, upload2.Head)
+	assert.True(upload2.PlatformLinux)
+
+	// indexes are rebuilt on load
+	assert.Len(s2.ListUploadsByGame(game.ID), 1)
+	assert.Len(s2.ListBuildsByUpload(upload.ID), 1)
+	assert.NotNil(s2.FindBuild(upload.Head).GetFile("archive", "default"))
+
+	// new objects must not collide with loaded ones
+	build2 := upload2.PushBuild(func(ac *ArchiveContext) {
+		ac.Entry("data.bin").Random(0x2, 4096)
+	})
+	assert.True(build2.ID > upload.Head)
+	assert.EqualValues(upload.Head, build2.ParentBuildID)
+}
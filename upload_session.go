@@ -0,0 +1,108 @@
+package mitch
+
+import (
+	pathpkg "path"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// MakeUploadSession starts a resumable upload (GCS-style) that
+// will end up in CDNFiles at the given path once complete.
+func (s *Store) MakeUploadSession(path string) *UploadSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.makeUploadSession(path)
+}
+
+func (s *Store) makeUploadSession(path string) *UploadSession {
+	us := &UploadSession{
+		ID:       uuid.New().String(),
+		Path:     path,
+		Filename: pathpkg.Base(path),
+	}
+	s.UploadSessions[us.ID] = us
+	return us
+}
+
+func (us *UploadSession) Offset() int64 {
+	return int64(len(us.Contents))
+}
+
+// Write appends a chunk starting at offset start. Bytes that were
+// already committed (from a retried chunk) are skipped. total is the
+// announced size of the whole upload, or -1 if it isn't known yet.
+func (us *UploadSession) Write(start int64, data []byte, total int64) error {
+	offset := us.Offset()
+	if start > offset {
+		return errors.Errorf("non-contiguous chunk: starts at %d, but only %d bytes committed", start, offset)
+	}
+	if total >= 0 && start+int64(len(data)) > total {
+		return errors.Errorf("chunk ends at %d, past announced total size %d", start+int64(len(data)), total)
+	}
+
+	skip := offset - start
+	if skip >= int64(len(data)) {
+		return nil
+	}
+	us.Contents = append(us.Contents, data[skip:]...)
+	return nil
+}
+
+// commit stores the assembled contents in CDNFiles, and forgets
+// about the session.
+func (us *UploadSession) commit(s *Store) *CDNFile {
+	delete(s.UploadSessions, us.ID)
+	return s.uploadCDNFile(us.Path, us.Filename, us.Contents)
+}
+
+// contentRange is a parsed "Content-Range" request header, as sent
+// by resumable upload clients. start is -1 for "bytes */..." (status
+// queries), and total is -1 when the final size isn't known yet ("/*").
+type contentRange struct {
+	start int64
+	end   int64
+	total int64
+}
+
+func parseContentRange(header string) (*contentRange, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return nil, errors.Errorf("invalid content-range %q", header)
+	}
+	tokens := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(tokens) != 2 {
+		return nil, errors.Errorf("invalid content-range %q", header)
+	}
+
+	cr := &contentRange{start: -1, end: -1, total: -1}
+	if tokens[1] != "*" {
+		total, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid content-range total %q", tokens[1])
+		}
+		cr.total = total
+	}
+
+	if tokens[0] != "*" {
+		startEnd := strings.SplitN(tokens[0], "-", 2)
+		if len(startEnd) != 2 {
+			return nil, errors.Errorf("invalid content-range %q", header)
+		}
+		start, err := strconv.ParseInt(startEnd[0], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid content-range start %q", startEnd[0])
+		}
+		end, err := strconv.ParseInt(startEnd[1], 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid content-range end %q", startEnd[1])
+		}
+		if end < start {
+			return nil, errors.Errorf("invalid content-range %q", header)
+		}
+		cr.start = start
+		cr.end = end
+	}
+	return cr, nil
+}
@@ -0,0 +1,131 @@
+package mitch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseContentRange(t *testing.T) {
+	assert := assert.New(t)
+
+	cr, err := parseContentRange("bytes 0-99/1000")
+	assert.NoError(err)
+	assert.EqualValues(&contentRange{start: 0, end: 99, total: 1000}, cr)
+
+	cr, err = parseContentRange("bytes 100-199/*")
+	assert.NoError(err)
+	assert.EqualValues(&contentRange{start: 100, end: 199, total: -1}, cr)
+
+	cr, err = parseContentRange("bytes */1000")
+	assert.NoError(err)
+	assert.EqualValues(&contentRange{start: -1, end: -1, total: 1000}, cr)
+
+	cr, err = parseContentRange("bytes */*")
+	assert.NoError(err)
+	assert.EqualValues(&contentRange{start: -1, end: -1, total: -1}, cr)
+
+	for _, header := range []string{
+		"",
+		"0-99/1000",
+		"items 0-99/1000",
+		"bytes 0-99",
+		"bytes 99-0/1000",
+		"bytes a-99/1000",
+		"bytes 0-b/1000",
+		"bytes 0/1000",
+		"bytes 0-99/lots",
+	} {
+		_, err = parseContentRange(header)
+		assert.Error(err, header)
+	}
+}
+
+func Test_ResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	start := func(uploadURL string) *http.Response {
+		req, err := http.NewRequest("POST", uploadURL, nil)
+		assert.NoError(err)
+		req.Header.Set("x-goog-resumable", "start")
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+
+	res := start(fmt.Sprintf("http://%s/@upload/uploads/foo.zip", srv.Address()))
+	assert.EqualValues(404, res.StatusCode, "only handed out paths can be uploaded to")
+	assert.Empty(store.UploadSessions)
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/@upload/uploads/foo.zip", srv.Address()), strings.NewReader("pwned"))
+	assert.NoError(err)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	assert.EqualValues(404, res.StatusCode)
+	assert.Nil(store.FindCDNFile("/uploads/foo.zip"))
+
+	uploadURL := wharfUploadURL(t, srv, store.MakeUser("Some Developer"), "deferred_resumable")
+	res = start(uploadURL)
+	assert.EqualValues(201, res.StatusCode)
+	sessionURL := res.Header.Get("Location")
+	assert.Len(store.UploadSessions, 1)
+
+	put := func(contentRange string, body string) *http.Response {
+		req, err := http.NewRequest("PUT", sessionURL, strings.NewReader(body))
+		assert.NoError(err)
+		req.Header.Set("Content-Range", contentRange)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		return res
+	}
+
+	res = put("bytes 0-4/*", "01234")
+	assert.EqualValues(308, res.StatusCode)
+	assert.EqualValues("bytes=0-4", res.Header.Get("Range"))
+
+	// status query, nothing is written
+	res = put("bytes */*", "")
+	assert.EqualValues(308, res.StatusCode)
+	assert.EqualValues("bytes=0-4", res.Header.Get("Range"))
+
+	// retried chunk that overlaps what's already there
+	res = put("bytes 3-7/*", "34567")
+	assert.EqualValues(308, res.StatusCode)
+	assert.EqualValues("bytes=0-7", res.Header.Get("Range"))
+
+	res = put("bytes 10-11/*", "ab")
+	assert.EqualValues(400, res.StatusCode, "non-contiguous chunk")
+
+	res = put("bytes 8-11/10", "89ab")
+	assert.EqualValues(400, res.StatusCode, "chunk past total")
+	res = put("bytes */10", "")
+	assert.EqualValues(308, res.StatusCode)
+	assert.EqualValues("bytes=0-7", res.Header.Get("Range"), "nothing written past total")
+
+	res = put("bytes 8-9/10", "89")
+	assert.EqualValues(200, res.StatusCode)
+	assert.Empty(store.UploadSessions)
+
+	res = put("bytes */10", "")
+	assert.EqualValues(404, res.StatusCode)
+
+	res, err = http.Get(strings.Replace(uploadURL, "/@upload/", "/@cdn/", 1))
+	assert.NoError(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(err)
+	assert.EqualValues("0123456789", string(body))
+}
@@ -3,6 +3,7 @@ package mitch
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -12,18 +13,90 @@ func must(err error) {
 	}
 }
 
+// pageBounds returns the slice bounds of a given 1-based page.
+// page and perPage are clamped to 1, and huge values don't overflow.
+func pageBounds(total int, page int64, perPage int64) (start int, end int) {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = 1
+	}
+	if page-1 > int64(total)/perPage {
+		return total, total
+	}
+
+	start64 := (page - 1) * perPage
+	if start64 > int64(total) {
+		start64 = int64(total)
+	}
+	end64 := int64(total)
+	if perPage < end64-start64 {
+		end64 = start64 + perPage
+	}
+	return int(start64), int(end64)
+}
+
 func (s *Store) serial() int64 {
 	s.idSeed += 100
 	return s.idSeed
 }
 
 var (
-	invalidUsernameChars = regexp.MustCompile("^[A-Za-z0-9_]")
+	invalidSlugChars = regexp.MustCompile("[^a-z0-9]+")
 )
 
+// slugify turns a title into something usable in URLs and wharf
+// targets, like "My Cool Game" into "my-cool-game".
 func (s *Store) slugify(input string) string {
 	var res = input
 	res = strings.ToLower(res)
-	res = invalidUsernameChars.ReplaceAllString(res, "_")
+	res = invalidSlugChars.ReplaceAllString(res, "-")
+	res = strings.Trim(res, "-")
 	return res
 }
+
+// isValidRangeHeader returns false for Range headers that should be
+// ignored as per RFC 7233: units other than bytes, and syntax errors.
+// Unsatisfiable (but well-formed) ranges are valid, they get a 416.
+func isValidRangeHeader(header string) bool {
+	if !strings.HasPrefix(header, "bytes=") {
+		return false
+	}
+
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		tokens := strings.SplitN(spec, "-", 2)
+		if len(tokens) != 2 {
+			return false
+		}
+
+		if tokens[0] == "" {
+			// suffix range, like "-500"
+			if _, err := strconv.ParseUint(tokens[1], 10, 63); err != nil {
+				return false
+			}
+			continue
+		}
+
+		start, err := strconv.ParseUint(tokens[0], 10, 63)
+		if err != nil {
+			return false
+		}
+		if tokens[1] == "" {
+			continue
+		}
+		end, err := strconv.ParseUint(tokens[1], 10, 63)
+		if err != nil || end < start {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma-separated list, ignoring empty items
+func splitList(input string) []string {
+	return strings.FieldsFunc(input, func(r rune) bool {
+		return r == ','
+	})
+}
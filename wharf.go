@@ -0,0 +1,249 @@
+package mitch
+
+import (
+	"fmt"
+)
+
+type routeFunc func(route string, ch coolHandler)
+
+func (s *server) wharfRoutes(route routeFunc) {
+	route("/wharf/status", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.WriteJSON(Any{
+					"success": true,
+				})
+			},
+		})
+	})
+
+	route("/wharf/channels", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("wharf")
+				game := r.FindGameByTarget(r.Param("target"))
+				r.AssertAuthorization(game.CanBeEditedBy(r.currentUser))
+
+				channels := Any{}
+				for _, u := range r.store.listUploadsByGame(game.ID) {
+					if u.ChannelName == "" {
+						continue
+					}
+					channels[u.ChannelName] = FormatChannel(u)
+				}
+				r.WriteJSON(Any{
+					"channels": channels,
+				})
+			},
+		})
+	})
+
+	route("/wharf/channels/{channel}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("wharf")
+				game := r.FindGameByTarget(r.Param("target"))
+				r.AssertAuthorization(game.CanBeEditedBy(r.currentUser))
+
+				upload := r.store.findUploadByChannel(game.ID, r.Var("channel"))
+				if upload == nil {
+					Throw(404, "channel not found")
+				}
+				r.WriteJSON(Any{
+					"channel": FormatChannel(upload),
+				})
+			},
+		})
+	})
+
+	route("/wharf/builds", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAPIKey("wharf")
+				game := r.FindGameByTarget(r.Param("target"))
+				r.AssertAuthorization(game.CanBeEditedBy(r.currentUser))
+
+				channelName := r.Param("channel")
+				if channelName == "" {
+					Throw(400, "missing channel")
+				}
+
+				upload := r.store.findUploadByChannel(game.ID, channelName)
+				if upload == nil {
+					upload = game.makeUpload(channelName)
+					upload.ChannelName = channelName
+				}
+
+				build := upload.makeBuild()
+				build.UserVersion = r.Param("user_version")
+
+				r.WriteJSON(Any{
+					"build": Any{
+						"id":        build.ID,
+						"upload_id": build.UploadID,
+						"parent_build": Any{
+							"id": build.ParentBuildID,
+						},
+					},
+				})
+			},
+		})
+	})
+
+	route("/wharf/builds/{id}/files", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+				r.WriteJSON(Any{
+					"files": FormatBuildFiles(r.store.listBuildFilesByBuild(build.ID)),
+				})
+			},
+			"POST": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+
+				typ := r.Param("type")
+				if typ == "" {
+					Throw(400, "missing type")
+				}
+				subtype := r.Param("sub_type")
+				if subtype == "" {
+					subtype = "default"
+				}
+
+				// clients retry this when the response gets lost, so
+				// hand out the same file until it's been uploaded.
+				bf := build.getFile(typ, subtype)
+				if bf == nil {
+					bf = build.makeFile(typ, subtype)
+				} else if bf.Status == "uploaded" {
+					Throw(400, fmt.Sprintf("build already has a %s/%s file", typ, subtype))
+				}
+				bf.Status = "created"
+				bf.Filename = r.Param("filename")
+				if bf.Filename == "" {
+					bf.Filename = fmt.Sprintf("build-%d-%s-%s", build.ID, typ, subtype)
+				}
+
+				uploadURL := r.makeURL("/@upload%s", bf.CDNPath())
+				uploadHeaders := Any{}
+				switch r.Param("upload_type") {
+				case "resumable":
+					us := r.store.makeUploadSession(bf.CDNPath())
+					uploadURL = r.makeURL("/@upload%s?upload_id=%s", bf.CDNPath(), us.ID)
+				case "deferred_resumable":
+					// the client starts the upload session itself
+					uploadHeaders["x-goog-resumable"] = "start"
+				}
+
+				r.WriteJSON(Any{
+					"file": Any{
+						"id":             bf.ID,
+						"upload_url":     uploadURL,
+						"upload_params":  Any{},
+						"upload_headers": uploadHeaders,
+					},
+				})
+			},
+		})
+	})
+
+	route("/wharf/builds/{id}/files/{file_id}", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+				bf := r.FindWharfBuildFile(build, r.Int64Var("file_id"))
+
+				f := r.store.findCDNFile(bf.CDNPath())
+				if f == nil {
+					Throw(400, "build file was never uploaded")
+				}
+				if size := r.Param("size"); size != "" && size != fmt.Sprintf("%d", f.Size) {
+					Throw(400, fmt.Sprintf("size mismatch: expected %s, got %d", size, f.Size))
+				}
+
+				if build.State == "failed" {
+					Throw(400, "build has failed")
+				}
+				bf.setHostedContents(bf.Filename, f.Contents)
+				err := build.commitIfReady()
+				if err != nil {
+					Throw(400, fmt.Sprintf("build failed: %s", err.Error()))
+				}
+
+				r.WriteJSON(Any{})
+			},
+		})
+	})
+
+	route("/wharf/builds/{id}/files/{file_id}/download", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"GET": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+				bf := r.FindWharfBuildFile(build, r.Int64Var("file_id"))
+				if bf.Status != "uploaded" {
+					Throw(400, "build file is not uploaded yet")
+				}
+
+				r.WriteJSON(Any{
+					"url": r.makeURL("/@cdn%s", bf.CDNPath()),
+				})
+			},
+		})
+	})
+
+	route("/wharf/builds/{id}/events", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+				r.s.Logf("build %d event (%s): %s", build.ID, r.Param("type"), r.Param("message"))
+				r.WriteJSON(Any{})
+			},
+		})
+	})
+
+	route("/wharf/builds/{id}/failures", func(r *response) {
+		r.RespondTo(RespondToMap{
+			"POST": func() {
+				r.CheckAPIKey("wharf")
+				build := r.FindWharfBuild(r.Int64Var("id"))
+				r.s.Logf("build %d failed: %s", build.ID, r.Param("message"))
+				build.State = "failed"
+				r.WriteJSON(Any{})
+			},
+		})
+	})
+}
+
+func (r *response) FindGameByTarget(target string) *Game {
+	if target == "" {
+		Throw(400, "missing target")
+	}
+	game := r.store.findGameByTarget(target)
+	if game == nil {
+		Throw(404, "invalid target")
+	}
+	return game
+}
+
+// FindWharfBuild looks up a build and makes sure the current user
+// is allowed to push to it.
+func (r *response) FindWharfBuild(buildID int64) *Build {
+	build := r.FindBuild(buildID)
+	upload := r.FindUpload(build.UploadID)
+	game := r.FindGame(upload.GameID)
+	r.AssertAuthorization(game.CanBeEditedBy(r.currentUser))
+	return build
+}
+
+func (r *response) FindWharfBuildFile(build *Build, fileID int64) *BuildFile {
+	bf := r.store.findBuildFile(fileID)
+	if bf == nil || bf.BuildID != build.ID {
+		Throw(404, "build file not found")
+	}
+	return bf
+}
@@ -0,0 +1,186 @@
+package mitch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/itchio/arkive/zip"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Slugify(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStore()
+	assert.EqualValues("my-cool-game", s.slugify("My Cool Game"))
+	assert.EqualValues("some-developer", s.slugify("Some Developer"))
+	assert.EqualValues("rock-n-roll-2", s.slugify("  Rock'n'Roll 2!"))
+}
+
+// Test_WharfPush does what butler does when pushing: create a build,
+// upload its patch and signature, and wait for it to be processed.
+func Test_WharfPush(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv, err := NewServer(ctx)
+	assert.NoError(err)
+	store := srv.Store()
+
+	dev := store.MakeUser("Some Developer")
+	apiKey := dev.MakeAPIKey().Key
+	dev.MakeGame("My Cool Game")
+	target := "some-developer/my-cool-game"
+
+	makeArchive := func(contents string) []byte {
+		ac := &ArchiveContext{
+			Entries: make(map[string]*ArchiveEntry),
+			Name:    "archive.zip",
+		}
+		ac.Entry("hello.txt").String(contents)
+		ac.Entry("data.bin").Random(0x1, 64*1024)
+		return ac.CompressZip()
+	}
+
+	pushFile := func(buildID int64, typ string, contents []byte) {
+		path := fmt.Sprintf("/wharf/builds/%d/files", buildID)
+		status, payload := apiRequest(t, srv, "POST", path, apiKey, url.Values{"type": {typ}})
+		assert.EqualValues(200, status)
+		file := payload["file"].(map[string]interface{})
+		fileID := int64(file["id"].(float64))
+
+		// retrying before the upload hands out the same file
+		_, payload = apiRequest(t, srv, "POST", path, apiKey, url.Values{"type": {typ}})
+		assert.EqualValues(fileID, payload["file"].(map[string]interface{})["id"])
+
+		req, err := http.NewRequest("PUT", file["upload_url"].(string), bytes.NewReader(contents))
+		assert.NoError(err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		res.Body.Close()
+		assert.EqualValues(200, res.StatusCode)
+
+		status, _ = apiRequest(t, srv, "POST", fmt.Sprintf("%s/%d", path, fileID), apiKey, url.Values{
+			"size": {fmt.Sprintf("%d", len(contents))},
+		})
+		assert.EqualValues(200, status)
+
+		status, _ = apiRequest(t, srv, "POST", path, apiKey, url.Values{"type": {typ}})
+		assert.EqualValues(400, status)
+	}
+
+	download := func(uploadID int64) string {
+		res, err := http.Get(fmt.Sprintf("http://%s/uploads/%d/download?api_key=%s", srv.Address(), uploadID, apiKey))
+		assert.NoError(err)
+		defer res.Body.Close()
+		assert.EqualValues(200, res.StatusCode)
+		archive, err := ioutil.ReadAll(res.Body)
+		assert.NoError(err)
+
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		assert.NoError(err)
+		for _, f := range zr.File {
+			if f.Name == "hello.txt" {
+				r, err := f.Open()
+				assert.NoError(err)
+				defer r.Close()
+				contents, err := ioutil.ReadAll(r)
+				assert.NoError(err)
+				return string(contents)
+			}
+		}
+		t.Fatal("hello.txt not found in archive")
+		return ""
+	}
+
+	push := func(archive []byte, parentSignature []byte) (buildID int64, uploadID int64) {
+		status, payload := apiRequest(t, srv, "POST", "/wharf/builds", apiKey, url.Values{
+			"target":  {target},
+			"channel": {"windows"},
+		})
+		assert.EqualValues(200, status)
+		build := payload["build"].(map[string]interface{})
+		buildID = int64(build["id"].(float64))
+		uploadID = int64(build["upload_id"].(float64))
+
+		pushFile(buildID, "patch", diffArchive(archive, parentSignature))
+		pushFile(buildID, "signature", signArchive(archive))
+		return
+	}
+
+	v1 := makeArchive("version 1")
+	build1, uploadID := push(v1, nil)
+	assert.EqualValues("version 1", download(uploadID))
+
+	v2 := makeArchive("version 2")
+	build2, uploadID2 := push(v2, signArchive(v1))
+	assert.EqualValues(uploadID, uploadID2)
+	assert.EqualValues("version 2", download(uploadID))
+
+	status, payload := apiRequest(t, srv, "GET", "/wharf/channels/windows", apiKey, url.Values{"target": {target}})
+	assert.EqualValues(200, status)
+	head := payload["channel"].(map[string]interface{})["head"].(map[string]interface{})
+	assert.EqualValues(build2, head["id"])
+	assert.EqualValues(build1, head["parent_build_id"])
+
+	status, _ = apiRequest(t, srv, "GET", "/wharf/channels", apiKey, url.Values{"target": {"some-developer/nope"}})
+	assert.EqualValues(404, status)
+
+	// a malformed patch fails the build instead of taking the server down
+	status, payload = apiRequest(t, srv, "POST", "/wharf/builds", apiKey, url.Values{
+		"target":  {target},
+		"channel": {"windows"},
+	})
+	assert.EqualValues(200, status)
+	build3 := int64(payload["build"].(map[string]interface{})["id"].(float64))
+	pushFile(build3, "patch", []byte("not a patch"))
+
+	path := fmt.Sprintf("/wharf/builds/%d/files", build3)
+	_, payload = apiRequest(t, srv, "POST", path, apiKey, url.Values{"type": {"signature"}})
+	file := payload["file"].(map[string]interface{})
+	signature := signArchive(v2)
+	req, err := http.NewRequest("PUT", file["upload_url"].(string), bytes.NewReader(signature))
+	assert.NoError(err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(err)
+	res.Body.Close()
+	finalize := func() int {
+		status, _ := apiRequest(t, srv, "POST", fmt.Sprintf("%s/%d", path, int64(file["id"].(float64))), apiKey, url.Values{
+			"size": {fmt.Sprintf("%d", len(signature))},
+		})
+		return status
+	}
+	assert.EqualValues(400, finalize())
+	assert.EqualValues("failed", store.FindBuild(build3).State)
+	assert.EqualValues(400, finalize(), "retrying doesn't apply the patch again")
+	assert.EqualValues(build2, store.FindUpload(uploadID).Head)
+	assert.EqualValues("version 2", download(uploadID))
+}
+
+// wharfUploadURL starts a wharf build for a new game of dev and asks
+// for somewhere to upload its patch, the way butler does.
+func wharfUploadURL(t *testing.T, srv Server, dev *User, uploadType string) string {
+	assert := assert.New(t)
+
+	apiKey := dev.MakeAPIKey().Key
+	dev.MakeGame("Upload Target")
+	status, payload := apiRequest(t, srv, "POST", "/wharf/builds", apiKey, url.Values{
+		"target":  {dev.Username + "/upload-target"},
+		"channel": {"windows"},
+	})
+	assert.EqualValues(200, status)
+	buildID := int64(payload["build"].(map[string]interface{})["id"].(float64))
+
+	status, payload = apiRequest(t, srv, "POST", fmt.Sprintf("/wharf/builds/%d/files", buildID), apiKey, url.Values{
+		"type":        {"patch"},
+		"upload_type": {uploadType},
+	})
+	assert.EqualValues(200, status)
+	return payload["file"].(map[string]interface{})["upload_url"].(string)
+}